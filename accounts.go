@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	saltSize          = 16
+	hashSize          = 32
+	hashIterations    = 100000
+	guestNamePrefix   = "Anonymous"
+	minPasswordLength = 6
+)
+
+// account is a registered username, its salted password hash and the user's saved preferences.
+type account struct {
+	Name       string `json:"name"`
+	Salt       string `json:"salt"`
+	Hash       string `json:"hash"`
+	TimeZone   string `json:"tz,omitempty"`
+	TimeFormat string `json:"timefmt,omitempty"`
+}
+
+// accountStore encapsulates the registered accounts and saves them to a local file.
+// The file is written by the server so it is stored as JSON rather than TOML.
+type accountStore struct {
+	sync.RWMutex
+	path     string
+	accounts map[string]*account
+}
+
+// openAccountStore loads the accounts stored at path. A missing file is treated as no accounts.
+// An empty path keeps the accounts in memory only.
+func openAccountStore(path string) (*accountStore, error) {
+	as := &accountStore{
+		path:     path,
+		accounts: make(map[string]*account),
+	}
+	if path == "" {
+		return as, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return as, nil
+		}
+		return nil, err
+	}
+	var list []*account
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range list {
+		as.accounts[a.Name] = a
+	}
+	return as, nil
+}
+
+// save writes all the accounts to the store's file. It must be called with the lock held.
+func (as *accountStore) save() error {
+	if as.path == "" {
+		return nil
+	}
+	list := make([]*account, 0, len(as.accounts))
+	for _, a := range as.accounts {
+		list = append(list, a)
+	}
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it so a crash can't leave a partially written store.
+	tmp, err := ioutil.TempFile(filepath.Dir(as.path), ".tbit-accounts")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), as.path)
+}
+
+// isRegistered returns true if the username belongs to an account.
+func (as *accountStore) isRegistered(name string) bool {
+	as.RLock()
+	defer as.RUnlock()
+	_, ok := as.accounts[name]
+	return ok
+}
+
+// register creates a new account with the password.
+func (as *accountStore) register(name, password string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("password is too short")
+	}
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password, salt)
+	if err != nil {
+		return err
+	}
+
+	as.Lock()
+	defer as.Unlock()
+	if _, exists := as.accounts[name]; exists {
+		return errors.New("username is already registered")
+	}
+	as.accounts[name] = &account{
+		Name: name,
+		Salt: hex.EncodeToString(salt),
+		Hash: hex.EncodeToString(hash),
+	}
+	err = as.save()
+	if err != nil {
+		delete(as.accounts, name)
+		return err
+	}
+	return nil
+}
+
+// dummySalt is hashed with the password given for accounts that don't exist, see authenticate.
+var dummySalt = make([]byte, saltSize)
+
+// authenticate checks the password for an account.
+func (as *accountStore) authenticate(name, password string) error {
+	// Unknown accounts get the same error as wrong passwords, and are hashed against a dummy salt so they
+	// take as long, so logging in doesn't tell whether an account exists. /user still refuses registered names.
+	errInvalid := errors.New("invalid username or password")
+	as.RLock()
+	a, ok := as.accounts[name]
+	as.RUnlock()
+	if !ok {
+		hashPassword(password, dummySalt)
+		return errInvalid
+	}
+	salt, err := hex.DecodeString(a.Salt)
+	if err != nil {
+		return err
+	}
+	want, err := hex.DecodeString(a.Hash)
+	if err != nil {
+		return err
+	}
+	got, err := hashPassword(password, salt)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return errInvalid
+	}
+	return nil
+}
+
+// displayPrefs returns the saved display preferences of an account, or nil if it has none.
+func (as *accountStore) displayPrefs(name string) (*displayPrefs, error) {
+	as.RLock()
+	a, ok := as.accounts[name]
+	as.RUnlock()
+	if !ok || (a.TimeZone == "" && a.TimeFormat == "") {
+		return nil, nil
+	}
+	return newDisplayPrefs(a.TimeZone, a.TimeFormat)
+}
+
+// saveDisplayPrefs stores the display preferences of an account.
+func (as *accountStore) saveDisplayPrefs(name string, d *displayPrefs) error {
+	as.Lock()
+	defer as.Unlock()
+	a, ok := as.accounts[name]
+	if !ok {
+		return errors.New("account does not exist")
+	}
+	a.TimeZone = d.TimeZone
+	a.TimeFormat = d.TimeFormat
+	return as.save()
+}
+
+// hashPassword derives the stored hash of a password.
+func hashPassword(password string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, hashIterations, hashSize)
+}
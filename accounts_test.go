@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccountStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tbit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "accounts")
+
+	as, err := openAccountStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := as.register("alice", "short"); err == nil {
+		t.Fatal("expected an error registering a short password")
+	}
+	if err := as.register("alice", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := as.register("alice", "secret456"); err == nil {
+		t.Fatal("expected an error registering an existing account")
+	}
+
+	// Reopen the store to make sure the account was saved.
+	as, err = openAccountStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !as.isRegistered("alice") {
+		t.Fatal("expected alice to be registered after reopening the store")
+	}
+	if err := as.authenticate("alice", "secret123"); err != nil {
+		t.Fatalf("expected the password to be accepted, got %s", err)
+	}
+	if err := as.authenticate("alice", "wrong-password"); err == nil {
+		t.Fatal("expected a wrong password to be rejected")
+	}
+	if err := as.authenticate("bob", "secret123"); err == nil {
+		t.Fatal("expected an unknown account to be rejected")
+	}
+}
+
+func TestRenameToRegisteredUsername(t *testing.T) {
+	s := NewServer()
+	if err := s.accounts.register("alice", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	conn := &Conn{id: 1, server: s, username: "Anonymous1", rooms: make(map[string]bool)}
+	if err := s.usernames.addUsername(conn.id, conn.username); err != nil {
+		t.Fatal(err)
+	}
+	s.conns.add(conn)
+
+	if err := conn.Rename("alice"); err == nil {
+		t.Fatal("expected a guest to be refused a registered username")
+	}
+	if err := conn.Login("alice", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	if conn.username != "alice" || conn.account != "alice" {
+		t.Fatalf("expected to be logged in as alice, got username %q account %q", conn.username, conn.account)
+	}
+}
+
+func TestRenameToPeerUsername(t *testing.T) {
+	s := NewServer()
+	peers := map[uint32]string{1000: "robot"}
+	s.peerNames.add(peers)
+	guest := testConn(t, s, 1, "Anonymous1", "192.0.2.1:1000")
+	if err := guest.Rename("robot"); err == nil {
+		t.Fatal("expected a guest to be refused a username mapped by PeerUsers")
+	}
+	admin := testConn(t, s, 2, "alice", "192.0.2.2:1000")
+	admin.admin = 1
+	if err := admin.AdminRename("Anonymous1", "robot"); err == nil {
+		t.Fatal("expected an admin rename to a username mapped by PeerUsers to be refused")
+	}
+	robot := testConn(t, s, 3, "bot", "192.0.2.3:1000")
+	robot.account = "robot"
+	if err := robot.Rename("robot"); err != nil {
+		t.Fatalf("expected the peer user to take its own username, got %v", err)
+	}
+
+	s.peerNames.remove(peers)
+	if s.peerNames.has("robot") {
+		t.Error("expected the username to be released once its listener stops")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// adminUsage lists the /admin subcommands.
+const adminUsage = "Usage is /admin login <password>, /admin notice <text>, /admin kill <id> [reason], " +
+	"/admin rename <user> <username> or /admin delroom <room>"
+
+// SetAuditLog sets where the admin actions are written, they are discarded until it is set.
+// It is safe to call while the server is running.
+func (s *Server) SetAuditLog(w io.Writer) {
+	s.audit.SetOutput(w)
+}
+
+// isAdmin returns true if the connection has logged in to an account listed in Admins,
+// or has given the AdminPassword with /admin login.
+func (c *Conn) isAdmin() bool {
+	if atomic.LoadInt32(&c.admin) == 1 {
+		return true
+	}
+	if c.account == "" {
+		return false
+	}
+	for _, name := range c.server.options().Admins {
+		if name == c.account {
+			return true
+		}
+	}
+	return false
+}
+
+// auditf writes an action taken by the connection to the audit log.
+func (c *Conn) auditf(format string, a ...interface{}) {
+	c.server.audit.Printf("connection %d %s from %s: %s\n", c.id, c.name(), c.remoteAddr, fmt.Sprintf(format, a...))
+}
+
+// AdminLogin makes the connection an admin if the password is the AdminPassword.
+func (c *Conn) AdminLogin(password string) error {
+	adminPassword := c.server.options().AdminPassword
+	if adminPassword == "" || subtle.ConstantTimeCompare([]byte(password), []byte(adminPassword)) != 1 {
+		c.auditf("failed admin login")
+		return errors.New("Incorrect admin password")
+	}
+	atomic.StoreInt32(&c.admin, 1)
+	c.auditf("logged in as an admin")
+	return nil
+}
+
+// AdminNotice announces a notice to every room.
+func (c *Conn) AdminNotice(text string) {
+	c.auditf("notice %q", text)
+	c.server.broadcastAll(text)
+}
+
+// AdminKill disconnects a connection.
+func (c *Conn) AdminKill(id int, reason string) error {
+	target := c.server.conns.get(id)
+	if target == nil {
+		return fmt.Errorf("There is no connection %d", id)
+	}
+	if reason == "" {
+		reason = "disconnected by an admin"
+	}
+	c.auditf("killed connection %d %s (%s)", id, target.name(), reason)
+	target.disconnect(reason)
+	return nil
+}
+
+// AdminRename changes the username of another connection.
+func (c *Conn) AdminRename(username, newUsername string) error {
+	target := c.server.lookupConn(username)
+	if target == nil {
+		return fmt.Errorf("There is no user named %s", username)
+	}
+	if c.server.accounts.isRegistered(newUsername) {
+		return errors.New("That username is registered")
+	}
+	if c.server.peerNames.has(newUsername) {
+		return errors.New("That username is reserved for a local user")
+	}
+	err := target.rename(newUsername)
+	if err != nil {
+		return err
+	}
+	c.auditf("renamed %s to %s", username, newUsername)
+	return nil
+}
+
+// AdminDeleteRoom removes everyone from a room and deletes it.
+func (c *Conn) AdminDeleteRoom(roomName string) error {
+	if roomName == c.server.options().DefaultRoom {
+		return errors.New("The default room can't be deleted")
+	}
+	r := c.server.rooms.get(roomName)
+	if r == nil {
+		return errors.New("That room does not exist")
+	}
+	if r.info().permanent {
+		return errors.New("Permanent rooms can't be deleted, remove them from the config file first")
+	}
+	c.auditf("deleted room %s", roomName)
+	for _, member := range r.members() {
+		username := member.name()
+		body := fmt.Sprintf("%s was removed since the room was deleted by an admin", username)
+		member.removeFromRoom(roomName, &Message{Kind: KindLeave, Sender: username, Body: body})
+	}
+	c.server.rooms.remove(roomName)
+	return nil
+}
+
+// handleAdmin performs the actions of the /admin command.
+func (c *Conn) handleAdmin(input string, fields []string) {
+	if len(fields) < 2 {
+		c.replyError(adminUsage)
+		return
+	}
+	if fields[1] == "login" {
+		if len(fields) != 3 {
+			c.replyError("Usage is /admin login <password>")
+			return
+		}
+		err := c.AdminLogin(fields[2])
+		if err != nil {
+			c.replyError(err.Error())
+			return
+		}
+		c.reply("You are now an admin")
+		return
+	}
+	if !c.isAdmin() {
+		c.replyError("You are not an admin")
+		return
+	}
+	var err error
+	switch fields[1] {
+	case "notice":
+		text := trailingText(input, 2)
+		if text == "" {
+			c.replyError("Usage is /admin notice <text>")
+			return
+		}
+		c.AdminNotice(text)
+	case "kill":
+		if len(fields) < 3 {
+			c.replyError("Usage is /admin kill <id> [reason]")
+			return
+		}
+		id, convErr := strconv.Atoi(fields[2])
+		if convErr != nil {
+			c.replyError("The connection id must be a number, see /whois")
+			return
+		}
+		err = c.AdminKill(id, trailingText(input, 3))
+	case "rename":
+		if len(fields) != 4 {
+			c.replyError("Usage is /admin rename <user> <username>")
+			return
+		}
+		err = c.AdminRename(fields[2], fields[3])
+	case "delroom":
+		if len(fields) != 3 {
+			c.replyError("Usage is /admin delroom <room>")
+			return
+		}
+		err = c.AdminDeleteRoom(fields[2])
+	default:
+		err = errors.New(adminUsage)
+	}
+	if err != nil {
+		c.replyError(err.Error())
+		return
+	}
+	c.replyf("Done: %s", strings.Join(fields[1:], " "))
+}
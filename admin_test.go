@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAdminCommands(t *testing.T) {
+	s := NewServer()
+	s.Admins = []string{"root"}
+	s.AdminPassword = "hunter2"
+	var audit bytes.Buffer
+	s.SetAuditLog(&audit)
+	admin := testConn(t, s, 1, "alice", "192.0.2.1:1000")
+	troll := testConn(t, s, 2, "troll", "198.51.100.7:1000")
+	if err := troll.JoinRoom("den", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if admin.isAdmin() {
+		t.Fatal("expected a guest not to be an admin")
+	}
+	if err := admin.AdminLogin("wrong"); err == nil {
+		t.Fatal("expected the wrong admin password to be refused")
+	}
+	if err := admin.AdminLogin("hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if !admin.isAdmin() {
+		t.Fatal("expected the admin password to make the connection an admin")
+	}
+	if _, _, err := admin.opRoom("den"); err != nil {
+		t.Errorf("expected admins to operate every room, got %s", err)
+	}
+
+	if err := admin.AdminRename("troll", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if troll.name() != "renamed" || s.lookupConn("renamed") != troll {
+		t.Errorf("expected the troll to be renamed, got %s", troll.name())
+	}
+	if err := admin.AdminDeleteRoom("den"); err != nil {
+		t.Fatal(err)
+	}
+	if s.rooms.get("den") != nil || troll.inRoom("den") {
+		t.Error("expected the room to be deleted and emptied")
+	}
+	if err := admin.AdminDeleteRoom(defaultRoom); err == nil {
+		t.Error("expected the default room not to be deleted")
+	}
+
+	for _, want := range []string{
+		"connection 1 alice from 192.0.2.1:1000: failed admin login",
+		"connection 1 alice from 192.0.2.1:1000: logged in as an admin",
+		"renamed troll to renamed",
+		"deleted room den",
+	} {
+		if !strings.Contains(audit.String(), want) {
+			t.Errorf("expected the audit log to contain %q, got:\n%s", want, audit.String())
+		}
+	}
+
+	// Logging in to an account listed in Admins makes a connection an admin.
+	root := testConn(t, s, 3, "root", "192.0.2.2:1000")
+	root.account = "root"
+	if !root.isAdmin() {
+		t.Error("expected an account listed in Admins to be an admin")
+	}
+}
+
+func TestAdminOverrideAudit(t *testing.T) {
+	s := NewServer()
+	s.AdminPassword = "hunter2"
+	var audit bytes.Buffer
+	s.SetAuditLog(&audit)
+	admin := testConn(t, s, 1, "alice", "192.0.2.1:1000")
+	owner := testConn(t, s, 2, "owner", "192.0.2.2:1000")
+	bob := testConn(t, s, 3, "bob", "198.51.100.7:1000")
+	for _, c := range []*Conn{owner, bob} {
+		if err := c.JoinRoom("den", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := admin.AdminLogin("hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Actions by the room's own operator aren't admin actions.
+	if err := owner.Topic("den", "owned"); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.Mute("den", "bob", 0); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(audit.String(), "den") {
+		t.Fatalf("expected an operator's actions not to be audited, got:\n%s", audit.String())
+	}
+
+	for _, action := range []struct {
+		do   func() error
+		want string
+	}{
+		{func() error { return admin.Op("den", "bob", true) }, "set operator bob to true in den"},
+		{func() error { return admin.Unmute("den", "bob") }, "unmuted bob in den"},
+		{func() error { return admin.Mute("den", "bob", 0) }, "muted bob in den"},
+		{func() error { return admin.Invite("den", "bob") }, "invited bob to den"},
+		{func() error { return admin.Mode("den", "+key", "secret") }, "set mode +key in den"},
+		{func() error { return admin.Topic("den", "taken over") }, `changed the topic of den to "taken over"`},
+		{func() error { return admin.Describe("den", "a den") }, `changed the description of den to "a den"`},
+		{func() error { return admin.Kick("den", "bob", "spam") }, "kicked bob from den (spam)"},
+		{func() error { return admin.Ban("den", "bob", 0) }, "banned bob from den"},
+		{func() error { return admin.Unban("den", "bob") }, "unbanned bob from den"},
+	} {
+		if err := action.do(); err != nil {
+			t.Fatalf("%s: %s", action.want, err)
+		}
+		if !strings.Contains(audit.String(), "connection 1 alice from 192.0.2.1:1000: "+action.want+"\n") {
+			t.Errorf("expected the audit log to contain %q, got:\n%s", action.want, audit.String())
+		}
+	}
+	if strings.Contains(audit.String(), "secret") {
+		t.Error("expected the room key not to be logged")
+	}
+}
+
+func TestAdminSettings(t *testing.T) {
+	config := defaultSettings()
+	err := config.readConfig(strings.NewReader(`
+Admins = ["root", "alice"]
+AdminPassword = "hunter2"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := config.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.Admins) != 2 || opts.Admins[1] != "alice" || opts.AdminPassword != "hunter2" {
+		t.Errorf("expected the admin settings to be read, got %q %q", opts.Admins, opts.AdminPassword)
+	}
+
+	next := config
+	next.AdminPassword = "correct horse"
+	_, changes := reloadSettings(config, next)
+	if len(changes) != 1 || changes[0] != "AdminPassword changed" {
+		t.Errorf("expected the new admin password not to be logged, got %q", changes)
+	}
+}
@@ -6,67 +6,302 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var helpText = `Welcome to Tbit chat!
+// defaultHelpText is the reply to /help when HelpText isn't set in the config file.
+const defaultHelpText = `Welcome to Tbit chat!
 Commands:
 /help - this text
 /exit - close your connection
 /quit - close your connection
 /user <username> - change your username
-/rooms - lists rooms that have been created
-/join <room> - joins a new room
+/rooms - lists rooms with how many users are in them, whether they are permanent or ad-hoc, and their topics
+/join <room> [key] - joins a new room, the key is needed for rooms that have one
 /leave <room> - leaves a room you are in
 /list - lists which rooms you are currently in
 /say <room> <message> - used to send a message to a specific room
+/who <room> - lists the users in a room
+/topic <room> [topic] - shows the topic of a room or changes it
+/describe <room> <description> - changes the description of a room
+/roominfo <room> - shows the topic, description, creator and modes of a room
+/mode <room> [+mode|-mode] [key] - shows the modes of a room or changes one, the modes are:
+    topic - only operators can change the topic
+    private - the room is hidden from everyone who isn't in it
+    invite - only invited users can join
+    key - the key has to be given to join, set with /mode <room> +key <key>
+/invite <room> <user> - lets a user join a room once, even if it is invite only or has a key
+/msg <user> <message> - sends a private message to a user
+/whois <user> - shows information about a user
+/op <room> <user> - makes a user an operator of a room, the first person to join a new room operates it
+/deop <room> <user> - stops a user being an operator of a room
+/kick <room> <user> [reason] - removes a user from a room
+/ban <room> [mask [duration]] - bans an IP, network or username pattern from a room, or lists the bans
+/unban <room> <mask> - removes a ban
+/mute <room> [user|mask [duration]] - stops a user, or an IP, network or username pattern, talking in a room, or lists the mutes
+/unmute <room> <user|mask> - lets a user talk in a room again, or removes a mute
+/admin login <password> - makes you an admin
+/admin notice <text> - announces a notice to every room, admins only
+/admin kill <id> [reason] - disconnects a connection, admins only
+/admin rename <user> <username> - changes someone's username, admins only
+/admin delroom <room> - removes everyone from a room and deletes it, admins only
+/proto <text|json> - changes the format of everything sent to you
+/ping [token] - checks the connection, the server answers with PONG and the token
+/pong <token> - answers a PING from the server, which disconnects clients that don't answer
+/set - shows your settings
+/set tz <timezone> - shows timestamps in an IANA timezone such as America/New_York
+/set timefmt <rfc3339|short|none|layout> - changes how timestamps are shown, a layout is like "Jan _2 15:04:05"
 `
 
-var welcomeText = `Welcome to Tbit chat!
+// defaultWelcomeText is sent to new connections when WelcomeText isn't set in the config file.
+// {username} is replaced with the connection's username.
+const defaultWelcomeText = `Welcome to Tbit chat!
 Type /help for a list of commands.
-Your username is currently: %s
+Your username is currently: {username}
 Use the "/user <username>" command to change it
 `
 
+// defaultOutputBufferSize is the number of messages queued for each connection when OutputBufferSize isn't set.
+const defaultOutputBufferSize = 100
+
+var loginRequiredText = "You must log in to chat, use /login <username> <password> or /register <username> <password>"
+
 // Conn holds all the data needed for a specific connection
 type Conn struct {
-	c          io.ReadWriteCloser
-	server     *Server
-	id         int
+	c      io.ReadWriteCloser
+	server *Server
+	// listener is the policy of the listener the connection was accepted on, it is nil for connections without one.
+	listener *Listener
+	id       int
+	// username is read with name, since admins can change it from other connections.
 	username   string
-	outputChan chan string
+	nameLock   sync.RWMutex
+	outputChan chan *Message
 	closeChan  chan struct{}
 	rooms      map[string]bool
+	// roomsLock guards rooms, which operators change from other connections when they kick.
+	roomsLock sync.Mutex
+	// account is the registered username this connection has logged in to, or empty for guests.
+	account    string
+	remoteAddr string
+	connected  time.Time
+	// admitted is set when the connection is counted by the server's limits, under limitKey.
+	admitted bool
+	limitKey string
+	// lastInput is the UnixNano time of the last input, it is accessed atomically since /whois reads it from other connections.
+	lastInput int64
+	// proto is the protocol used for output, it is accessed atomically since handleMessages renders messages for it.
+	proto int32
+	// display holds the *displayPrefs used to render timestamps, it is replaced when the user changes them.
+	display atomic.Value
+	// dropped counts the messages dropped since the connection last caught up, it is accessed atomically.
+	dropped int64
+	// pinged is the UnixNano time the last PING was sent, it is accessed atomically.
+	pinged    int64
+	idleTimer *time.Timer
+	// idleLock guards re-arming idleTimer, idleStopped is set by Close so a running checkIdle doesn't re-arm it.
+	idleLock    sync.Mutex
+	idleStopped bool
+	// admin is set to 1 once the connection has given the AdminPassword, it is accessed atomically.
+	admin int32
+	// quitReason holds the reason given to disconnect, which is included in the messages for leaving rooms.
+	quitReason atomic.Value
+	// pending holds the messages that didn't fit in outputChan and are waiting to be written, see deliver.
+	pending        []pendingMessage
+	pendingLock    sync.Mutex
+	disconnectOnce sync.Once
 }
 
-// NewConn creates a Conn.
-func (s *Server) NewConn(c io.ReadWriteCloser, id int) *Conn {
+// NewConn creates a Conn. l is the listener it was accepted on, or nil if it has no Listener.
+func (s *Server) NewConn(c io.ReadWriteCloser, id int, l *Listener) *Conn {
+	opts := s.options()
 	conn := &Conn{
 		c:          c,
 		server:     s,
+		listener:   l,
 		id:         id,
-		username:   fmt.Sprintf("Anonymous%d", id),
-		outputChan: make(chan string, outputBufSize),
+		username:   fmt.Sprintf("%s%d", guestNamePrefix, id),
+		outputChan: make(chan *Message, opts.OutputBufferSize),
 		closeChan:  make(chan struct{}),
 		rooms:      make(map[string]bool),
+		connected:  time.Now(),
 	}
-	err := conn.server.usernames.addUsername(conn.id, conn.username)
-	if err != nil {
-		log.Println(err)
-		return nil
+	conn.lastInput = conn.connected.UnixNano()
+	if l != nil && l.JSON {
+		conn.proto = protoJSON
+	}
+	if addr, ok := c.(interface{ RemoteAddr() net.Addr }); ok {
+		conn.remoteAddr = addr.RemoteAddr().String()
+	}
+	if name := conn.identifyPeer(); name != "" {
+		err := s.usernames.addUsername(conn.id, name)
+		if err == nil {
+			conn.username = name
+			conn.account = name
+			log.Printf("connection %d logged in as %s by its user id\n", conn.id, name)
+			conn.restoreDisplayPrefs()
+		} else {
+			log.Printf("connection %d is a guest since it can't use %s: %s\n", conn.id, name, err)
+		}
+	}
+	if conn.account == "" {
+		err := s.usernames.addUsername(conn.id, conn.username)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+	}
+	conn.server.conns.add(conn)
+	// When login is required guests join the lobby once they have logged in.
+	if conn.loggedIn() {
+		err := conn.JoinRoom(opts.DefaultRoom, "")
+		if err != nil {
+			log.Printf("connection %d can't join %s: %s\n", conn.id, opts.DefaultRoom, err)
+		}
 	}
-	conn.JoinRoom("lobby")
 	return conn
 }
 
-func (c Conn) inRoom(roomName string) bool {
+// identifyPeer records the user id of the process on the other end of a unix socket in remoteAddr.
+// It returns the username the listener maps that user id to, or an empty string if there isn't one.
+func (c *Conn) identifyPeer() string {
+	uid, ok := peerIdentity(c.c)
+	if !ok {
+		return ""
+	}
+	c.remoteAddr = fmt.Sprintf("unix uid %d", uid)
+	if c.listener == nil {
+		return ""
+	}
+	return c.listener.PeerUsers[uid]
+}
+
+// requireLogin returns true if guests on this connection must log in before chatting.
+func (c *Conn) requireLogin() bool {
+	return c.server.options().RequireLogin || (c.listener != nil && c.listener.RequireLogin)
+}
+
+// loggedIn returns true if the connection is allowed to chat.
+func (c *Conn) loggedIn() bool {
+	return c.account != "" || !c.requireLogin()
+}
+
+// Rename changes the username of the connection and announces the change to all rooms it is in.
+func (c *Conn) Rename(username string) error {
+	if username != c.account && c.server.accounts.isRegistered(username) {
+		return errors.New("That username is registered, use /login to use it")
+	}
+	if username != c.account && c.server.peerNames.has(username) {
+		return errors.New("That username is reserved for a local user")
+	}
+	return c.rename(username)
+}
+
+// rename changes the username without checking if it is registered, it is safe to call from any goroutine
+// so admins can rename other connections.
+func (c *Conn) rename(username string) error {
+	if username == "server" {
+		return errors.New("Username cannot be 'server'")
+	}
+	if strings.HasPrefix(username, "@") {
+		return errors.New("Username cannot start with @, it marks room operators")
+	}
+	c.nameLock.Lock()
+	oldUsername := c.username
+	err := c.server.usernames.modifyUsername(c.id, username)
+	if err != nil {
+		c.nameLock.Unlock()
+		return err
+	}
+	c.username = username
+	c.nameLock.Unlock()
+	c.announce(Message{
+		Kind:   KindNick,
+		Sender: oldUsername,
+		Nick:   username,
+		Body:   fmt.Sprintf("%s is now known as %s", oldUsername, username),
+	})
+	return nil
+}
+
+// name returns the username of the connection.
+func (c *Conn) name() string {
+	c.nameLock.RLock()
+	defer c.nameLock.RUnlock()
+	return c.username
+}
+
+// Login authenticates the connection as a registered account and changes to its username.
+func (c *Conn) Login(username, password string) error {
+	err := c.server.accounts.authenticate(username, password)
+	if err != nil {
+		return err
+	}
+	previous := c.account
+	c.account = username
+	if username != c.name() {
+		err = c.Rename(username)
+		if err != nil {
+			c.account = previous
+			if c.server.lookupConn(username) != nil {
+				return errors.New("That account is already logged in")
+			}
+			return err
+		}
+	}
+	log.Printf("connection %d logged in as %s\n", c.id, username)
+	c.restoreDisplayPrefs()
+	if previous == "" && c.requireLogin() {
+		room := c.server.options().DefaultRoom
+		if err := c.JoinRoom(room, ""); err != nil {
+			c.replyError(fmt.Sprintf("Can't join %s: %s", room, err))
+		}
+	}
+	return nil
+}
+
+// restoreDisplayPrefs uses the display preferences saved by the account the connection logged in to.
+func (c *Conn) restoreDisplayPrefs() {
+	d, err := c.server.accounts.displayPrefs(c.account)
+	if err != nil {
+		log.Printf("ignoring saved settings of %s: %s\n", c.account, err)
+	} else if d != nil {
+		c.display.Store(d)
+	}
+}
+
+// Register creates an account for the username and logs the connection in to it.
+func (c *Conn) Register(username, password string) error {
+	if username == "server" || strings.HasPrefix(username, guestNamePrefix) {
+		return errors.New("That username cannot be registered")
+	}
+	if username != c.name() && c.server.lookupConn(username) != nil {
+		return errors.New("username already exists")
+	}
+	err := c.server.accounts.register(username, password)
+	if err != nil {
+		return err
+	}
+	log.Printf("connection %d registered %s\n", c.id, username)
+	return c.Login(username, password)
+}
+
+func (c *Conn) inRoom(roomName string) bool {
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
 	// don't have to check ', ok' since if ok is false, then inRoom would be as well.
 	inRoom := c.rooms[roomName]
 	return inRoom
 }
 
 func (c *Conn) listRooms() []string {
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
 	list := make([]string, 0, len(c.rooms))
 	for r, inRoom := range c.rooms {
 		if !inRoom {
@@ -78,55 +313,203 @@ func (c *Conn) listRooms() []string {
 	return list
 }
 
-// JoinRoom joins this connection to a room and announces the joining. It creates the room if it doesn't exist.
-func (c *Conn) JoinRoom(roomName string) {
-	r := c.server.rooms.get(roomName)
-	if r == nil {
-		r = c.server.rooms.create(roomName)
+// JoinRoom joins this connection to a room, replays the room's backlog to it and announces the joining.
+// It creates the room if it doesn't exist, making this connection its operator.
+// key is needed to join a room with the key mode. Only invited connections can join invite only rooms,
+// admins can join any room they aren't banned from.
+func (c *Conn) JoinRoom(roomName, key string) error {
+	r, created := c.server.rooms.create(roomName, c.server.roomOptions(roomName))
+	invited := false
+	if !created && !c.isAdmin() {
+		var err error
+		invited, err = r.checkAccess(c.id, key)
+		if err != nil {
+			return err
+		}
+	}
+	err := r.Join(c)
+	if err == errRoomRemoved {
+		// The room was empty and removed after it was looked up, joining again creates it.
+		return c.JoinRoom(roomName, key)
+	}
+	if err != nil {
+		return err
 	}
-	r.Join(c)
-	// This is only called from the goroutine for Conn.handleConnection() so locking c.rooms is not nessisary.
+	// The invite is only used up by a join that succeeds, so a refused join such as for a ban doesn't waste it.
+	if invited {
+		r.useInvite(c.id)
+	}
+	if created {
+		r.setOp(c.id, true)
+		r.setCreator(c.name())
+	}
+	c.roomsLock.Lock()
 	c.rooms[roomName] = true
-	r.Announce(fmt.Sprintf("%s has joined the room", c.username), "server")
+	c.roomsLock.Unlock()
+	r.broadcast(&Message{Kind: KindJoin, Sender: c.name(), Body: fmt.Sprintf("%s has joined the room", c.name())})
+	if m := r.topicMessage(); m != nil {
+		c.send(m)
+	}
+	return nil
 }
 
 // LeaveRoom leaves a room that the connection is in.
 func (c *Conn) LeaveRoom(roomName string) error {
-	if !c.inRoom(roomName) {
+	return c.leaveRoom(roomName, "")
+}
+
+// leaveRoom leaves a room, the reason is added to the message telling the room if it isn't empty.
+func (c *Conn) leaveRoom(roomName, reason string) error {
+	body := fmt.Sprintf("%s has left the room", c.name())
+	if reason != "" {
+		body = fmt.Sprintf("%s (%s)", body, reason)
+	}
+	return c.removeFromRoom(roomName, &Message{Kind: KindLeave, Sender: c.name(), Body: body})
+}
+
+// removeFromRoom takes the connection out of a room, telling the room with the message.
+// It is safe to call from any goroutine, operators use it to kick other connections.
+func (c *Conn) removeFromRoom(roomName string, m *Message) error {
+	c.roomsLock.Lock()
+	if !c.rooms[roomName] {
+		c.roomsLock.Unlock()
 		return errors.New("you are not currently in that room")
 	}
 	c.rooms[roomName] = false
+	c.roomsLock.Unlock()
 	r := c.server.rooms.get(roomName)
 	if r == nil {
 		return errors.New("you were in a room that did not exist")
 	}
-	r.Announce(fmt.Sprintf("%s has left the room", c.username), "server")
+	r.broadcast(m)
 	r.Leave(c)
 	return nil
 }
 
-// Announce sends a message to all rooms this connection is in.
-func (c *Conn) Announce(msg string) {
-	c.announce(msg, c.username)
+// Announce sends a message to all rooms this connection is in, except the ones it is muted in.
+// It returns an error naming the rooms it wasn't sent to.
+func (c *Conn) Announce(msg string) error {
+	var muted []string
+	for _, name := range c.listRooms() {
+		r := c.server.rooms.get(name)
+		if r == nil {
+			continue
+		}
+		if r.muted(c) {
+			muted = append(muted, name)
+			continue
+		}
+		r.broadcast(&Message{Kind: KindChat, Sender: c.name(), Body: msg})
+	}
+	if len(muted) > 0 {
+		return fmt.Errorf("You are muted in %s", strings.Join(muted, ", "))
+	}
+	return nil
 }
 
-func (c *Conn) announce(msg, username string) {
-	// This is only called from the goroutine for Conn.handleConnection() so locking c.rooms is not nessisary.
-	for r, inRoom := range c.rooms {
-		if inRoom {
-			c.server.rooms.get(r).Announce(msg, username)
+// announce sends a copy of the message to each room this connection is in.
+func (c *Conn) announce(m Message) {
+	for _, name := range c.listRooms() {
+		if r := c.server.rooms.get(name); r != nil {
+			roomMsg := m
+			r.broadcast(&roomMsg)
+		}
+	}
+}
+
+// protocol returns the protocol used for the connection's output.
+func (c *Conn) protocol() int32 {
+	return atomic.LoadInt32(&c.proto)
+}
+
+// displayPrefs returns the preferences used to render timestamps for the connection.
+func (c *Conn) displayPrefs() *displayPrefs {
+	d, ok := c.display.Load().(*displayPrefs)
+	if !ok {
+		return defaultDisplayPrefs
+	}
+	return d
+}
+
+// setDisplayPrefs changes the preferences used to render timestamps and saves them for registered users.
+func (c *Conn) setDisplayPrefs(d *displayPrefs) error {
+	c.display.Store(d)
+	// Accounts mapped from PeerUsers aren't in the store, their preferences last as long as the connection.
+	if c.account == "" || !c.server.accounts.isRegistered(c.account) {
+		return nil
+	}
+	return c.server.accounts.saveDisplayPrefs(c.account, d)
+}
+
+// write renders a message for the connection's protocol and writes it directly to the connection.
+// It is called by handleMessages for the messages sent to the connection and by the goroutine for
+// Conn.handleConnection() for replies to commands. Each message is a single Write so they never interleave.
+// A connection that can't be written to within WriteTimeout is disconnected.
+func (c *Conn) write(m *Message) {
+	c.setWriteDeadline()
+	_, err := io.WriteString(c.c, m.render(c.protocol(), c.displayPrefs()))
+	if err != nil {
+		log.Printf("error writing to conn %d: %s\n", c.id, err)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			c.disconnect("timed out")
 		}
 	}
 }
 
-// handleMessages handles all the output messages for the connection.
+// reply writes the reply to a command.
+func (c *Conn) reply(text string) {
+	c.write(&Message{Kind: KindReply, Body: text})
+}
+
+// replyf writes the formatted reply to a command.
+func (c *Conn) replyf(format string, a ...interface{}) {
+	c.reply(fmt.Sprintf(format, a...))
+}
+
+// replyError writes the reason a command failed.
+func (c *Conn) replyError(text string) {
+	c.write(&Message{Kind: KindError, Body: text})
+}
+
+// replyList writes the title, each of the items and then the end of the list.
+func (c *Conn) replyList(title string, items []string) {
+	c.write(&Message{Kind: KindList, Body: title})
+	for _, item := range items {
+		c.write(&Message{Kind: KindItem, Body: item})
+	}
+	c.write(&Message{Kind: KindEnd})
+}
+
+// send queues a message on the connection's output channel using the server's slow consumer policy.
+func (c *Conn) send(msg *Message) {
+	c.deliver(msg, c.server.options().SlowConsumer)
+}
+
+// disconnect closes the underlying connection, which makes handleConnection return and clean up through Close.
+// It is safe to call from any goroutine.
+func (c *Conn) disconnect(reason string) {
+	c.disconnectOnce.Do(func() {
+		log.Printf("disconnecting connection %d: %s\n", c.id, reason)
+		c.quitReason.Store(reason)
+		c.c.Close()
+	})
+}
+
+// handleMessages handles all the output messages for the connection, rendering them for its protocol.
 func (c *Conn) handleMessages() {
 	for {
 		select {
 		case msg := <-c.outputChan:
-			_, err := io.WriteString(c.c, msg)
-			if err != nil {
-				log.Printf("error writing to conn %d: %s\n", c.id, err)
+			c.write(msg)
+			// Once the connection has caught up, write the messages that were waiting for room in
+			// the buffer and tell it about any messages it missed.
+			if len(c.outputChan) == 0 {
+				for _, m := range c.takePending() {
+					c.write(m)
+				}
+				if notice := c.missedNotice(); notice != nil {
+					c.write(notice)
+				}
 			}
 		case <-c.closeChan:
 			return
@@ -138,15 +521,20 @@ func (c *Conn) handleMessages() {
 func (c *Conn) Close() error {
 	var err error
 	c.closeChan <- struct{}{}
-	for r, inRoom := range c.rooms {
-		if inRoom {
-			e := c.LeaveRoom(r)
-			if e != nil {
-				err = e
-			}
+	c.stopIdleTimer()
+	reason, _ := c.quitReason.Load().(string)
+	for _, r := range c.listRooms() {
+		e := c.leaveRoom(r, reason)
+		if e != nil {
+			err = e
 		}
 	}
 
+	c.server.conns.remove(c.id)
+	c.server.rooms.forget(c.id)
+	if c.admitted {
+		c.server.limits.release(c.limitKey)
+	}
 	e := c.server.usernames.removeUsername(c.id)
 	if e != nil {
 		err = e
@@ -169,31 +557,58 @@ func (c *Conn) Close() error {
 func (c *Conn) handleConnection() {
 	defer c.Close()
 
-	fmt.Fprintf(c.c, welcomeText, c.username)
+	c.reply(strings.Replace(c.server.options().WelcomeText, "{username}", c.name(), -1))
+	if !c.loggedIn() {
+		c.replyError(loginRequiredText)
+	}
 
 	go c.handleMessages()
+	c.startIdleTimer()
 
 	scanner := bufio.NewScanner(c.c)
 	for scanner.Scan() {
 		input := scanner.Text()
+		atomic.StoreInt64(&c.lastInput, time.Now().UnixNano())
 
 		if input == "" {
 			continue
 		}
 
+		if c.protocol() == protoJSON && input[0] == '{' {
+			var err error
+			input, err = parseJSONInput(input)
+			if err != nil {
+				c.replyError(err.Error())
+				continue
+			}
+		}
+
 		if input[0] == '/' {
 			if !c.handleCommand(input) {
 				return
 			}
 			continue
 		}
-		c.Announce(input)
+		if !c.loggedIn() {
+			c.replyError(loginRequiredText)
+			continue
+		}
+		err := c.Announce(input)
+		if err != nil {
+			c.replyError(err.Error())
+		}
 	}
-	if err := scanner.Err(); err != nil {
+	// Shutdown stops connections reading with a deadline, so the timeout isn't an error.
+	if err := scanner.Err(); err != nil && !c.server.shuttingDown() {
 		log.Print("error scanning lines:", err)
 	}
 }
 
+// idle returns how long it has been since the connection last sent any input.
+func (c *Conn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastInput)))
+}
+
 // Say announces a message to a specific room
 func (c *Conn) Say(room, message string) error {
 	if !c.inRoom(room) {
@@ -204,10 +619,85 @@ func (c *Conn) Say(room, message string) error {
 		// should never happen
 		return errors.New("You were in a room that did not exist")
 	}
-	r.Announce(message, c.username)
+	if r.muted(c) {
+		return errors.New("You are muted in that room")
+	}
+	r.Announce(message, c.name())
+	return nil
+}
+
+// Msg sends a private message to another user and echoes it back to this connection.
+func (c *Conn) Msg(username, message string) error {
+	target := c.server.lookupConn(username)
+	if target == nil {
+		return fmt.Errorf("There is no user named %s", username)
+	}
+	// Private messages are logged with their own prefix so they can be audited or excluded from the room traffic.
+	log.Printf("PRIVATE %s -> %s: %s\n", c.name(), username, message)
+	m := &Message{Kind: KindPrivate, Sender: c.name(), To: username, Body: message}
+	m.stamp()
+	echo := *m
+	echo.Echo = true
+	target.send(m)
+	c.send(&echo)
 	return nil
 }
 
+// trailingText returns the input after skipping the first n fields, keeping the whitespace of the rest.
+func trailingText(input string, n int) string {
+	for i := 0; i < n; i++ {
+		input = strings.TrimLeft(input, " \t")
+		j := strings.IndexAny(input, " \t")
+		if j < 0 {
+			return ""
+		}
+		input = input[j:]
+	}
+	return strings.TrimLeft(input, " \t")
+}
+
+// handleSet performs the actions of the /set command.
+func (c *Conn) handleSet(input string, fields []string) {
+	current := c.displayPrefs()
+	if len(fields) == 1 {
+		timeZone := current.TimeZone
+		if timeZone == "" {
+			timeZone = "server default"
+		}
+		c.replyList("Your settings:", []string{
+			"tz: " + timeZone,
+			"timefmt: " + current.TimeFormat,
+		})
+		return
+	}
+	if len(fields) < 3 {
+		c.replyError("Usage is /set tz <timezone> or /set timefmt <rfc3339|short|none|layout>")
+		return
+	}
+	var d *displayPrefs
+	var err error
+	switch fields[1] {
+	case "tz":
+		d, err = current.withTimeZone(fields[2])
+	case "timefmt":
+		// Custom layouts can have spaces in them.
+		d, err = current.withTimeFormat(trailingText(input, 2))
+	default:
+		err = fmt.Errorf("Unknown setting %s, use tz or timefmt", fields[1])
+	}
+	if err != nil {
+		c.replyError(err.Error())
+		return
+	}
+	err = c.setDisplayPrefs(d)
+	if err != nil {
+		log.Printf("error saving settings of %s: %s\n", c.account, err)
+		c.replyError("Your setting was changed but could not be saved")
+		return
+	}
+	c.replyf("%s set to %s", fields[1], trailingText(input, 2))
+}
+
 // handleCommand performs the actions of a /command.
 // handleCommand returns false if handleConnection is to quit
 func (c *Conn) handleCommand(input string) bool {
@@ -215,73 +705,282 @@ func (c *Conn) handleCommand(input string) bool {
 	// As more commands are added we can add: type CommandFunc func(c *Conn, input string, fields []string)
 	// And then this switch can be changed to a map[string]CommandFunc.
 	switch fields[0] {
+	case "/help", "/exit", "/quit", "/register", "/login", "/proto", "/ping", "/pong":
+	default:
+		if !c.loggedIn() {
+			c.replyError(loginRequiredText)
+			return true
+		}
+	}
+	switch fields[0] {
 	case "/help":
-		io.WriteString(c.c, helpText)
+		c.reply(c.server.options().HelpText)
 	case "/exit", "/quit":
-		log.Printf("%s has disconnected\n", c.username)
+		log.Printf("%s has disconnected\n", c.name())
 		return false
-	case "/user":
-		if len(fields) != 2 {
-			fmt.Fprintln(c.c, "Usage is /user <username>")
+	case "/register":
+		if len(fields) != 3 {
+			c.replyError("Usage is /register <username> <password>")
 			return true
 		}
-		if fields[1] == "server" {
-			fmt.Fprintln(c.c, "Username cannot be 'server'")
+		err := c.Register(fields[1], fields[2])
+		if err != nil {
+			c.replyError(err.Error())
 			return true
 		}
-		oldUsername := c.username
-		err := c.server.usernames.modifyUsername(c.id, fields[1])
+		c.replyf("Registered and logged in as %s", c.name())
+	case "/login":
+		if len(fields) != 3 {
+			c.replyError("Usage is /login <username> <password>")
+			return true
+		}
+		err := c.Login(fields[1], fields[2])
 		if err != nil {
-			fmt.Fprintln(c.c, err)
+			c.replyError(err.Error())
 			return true
 		}
-		c.username = fields[1]
-		c.announce(fmt.Sprintf("%s is now known as %s\n", oldUsername, c.username), "server")
-	case "/join":
+		c.replyf("Logged in as %s", c.name())
+	case "/user":
 		if len(fields) != 2 {
-			fmt.Fprintln(c.c, "Usage is /join <room>")
+			c.replyError("Usage is /user <username>")
 			return true
 		}
-		c.JoinRoom(fields[1])
+		err := c.Rename(fields[1])
+		if err != nil {
+			c.replyError(err.Error())
+			return true
+		}
+	case "/join":
+		if len(fields) != 2 && len(fields) != 3 {
+			c.replyError("Usage is /join <room> [key]")
+			return true
+		}
+		err := c.JoinRoom(fields[1], strings.Join(fields[2:], ""))
+		if err != nil {
+			c.replyError(err.Error())
+		}
 	case "/leave":
 		if len(fields) != 2 {
-			fmt.Fprintln(c.c, "Usage is /leave <room>")
+			c.replyError("Usage is /leave <room>")
 			return true
 		}
 		err := c.LeaveRoom(fields[1])
 		if err != nil {
-			fmt.Fprintln(c.c, err)
+			c.replyError(err.Error())
 		}
 	case "/rooms":
-		fmt.Fprintln(c.c, "Here is a list of the current rooms:")
-		for _, r := range c.server.rooms.listAll() {
-			fmt.Fprintln(c.c, r)
+		var rooms []*Room
+		for _, name := range c.server.rooms.listAll() {
+			if r := c.visibleRoom(name); r != nil {
+				rooms = append(rooms, r)
+			}
 		}
-		// Output an empty line so the client has a way to know if the list has ended.
-		fmt.Fprintln(c.c, "")
+		c.replyRooms(rooms)
 	case "/list":
-		fmt.Fprintln(c.c, "You are in the following rooms:")
-		for _, r := range c.listRooms() {
-			fmt.Fprintln(c.c, r)
+		c.replyList("You are in the following rooms:", c.listRooms())
+	case "/who":
+		if len(fields) != 2 {
+			c.replyError("Usage is /who <room>")
+			return true
+		}
+		r := c.visibleRoom(fields[1])
+		if r == nil {
+			c.replyError("That room does not exist")
+			return true
+		}
+		c.replyList(fmt.Sprintf("Users in %s:", r.Name), r.listUsernames(c.server.usernames))
+	case "/whois":
+		if len(fields) != 2 {
+			c.replyError("Usage is /whois <user>")
+			return true
 		}
-		// Output an empty line so the client has a way to know if the list has ended.
-		fmt.Fprintln(c.c, "")
+		target := c.server.lookupConn(fields[1])
+		if target == nil {
+			c.replyError("That user does not exist")
+			return true
+		}
+		info := []string{
+			"rooms: " + strings.Join(c.visibleRooms(c.server.rooms.roomsWith(target.id)), " "),
+			"connected: " + target.connected.Format(time.RFC3339),
+			"idle: " + target.idle().Truncate(time.Second).String(),
+		}
+		// The address is only shown to admins.
+		if c.isAdmin() {
+			info = append(info, "address: "+target.remoteAddr)
+		}
+		c.replyList(fmt.Sprintf("%s is connection %d", fields[1], target.id), info)
 	case "/say":
 		if len(fields) < 3 {
-			fmt.Fprintln(c.c, "Usage is /say <room> <message>")
+			c.replyError("Usage is /say <room> <message>")
 			return true
 		}
-		// Find the index of the first message field of the input.
+		// Skip the command and room fields of the input.
 		// This way we don't loose the whitespace of the message.
-		i := strings.Index(input, fields[2])
-		msg := input[i:]
-		err := c.Say(fields[1], msg)
+		err := c.Say(fields[1], trailingText(input, 2))
+		if err != nil {
+			c.replyError(err.Error())
+			return true
+		}
+	case "/msg":
+		if len(fields) < 3 {
+			c.replyError("Usage is /msg <user> <message>")
+			return true
+		}
+		err := c.Msg(fields[1], trailingText(input, 2))
+		if err != nil {
+			c.replyError(err.Error())
+			return true
+		}
+	case "/op", "/deop":
+		if len(fields) != 3 {
+			c.replyError("Usage is " + fields[0] + " <room> <user>")
+			return true
+		}
+		err := c.Op(fields[1], fields[2], fields[0] == "/op")
 		if err != nil {
-			fmt.Fprintln(c.c, err)
+			c.replyError(err.Error())
+		}
+	case "/kick":
+		if len(fields) < 3 {
+			c.replyError("Usage is /kick <room> <user> [reason]")
+			return true
+		}
+		err := c.Kick(fields[1], fields[2], trailingText(input, 3))
+		if err != nil {
+			c.replyError(err.Error())
+		}
+	case "/ban":
+		if len(fields) < 2 || len(fields) > 4 {
+			c.replyError("Usage is /ban <room> [mask [duration]]")
+			return true
+		}
+		if len(fields) == 2 {
+			r, _, err := c.opRoom(fields[1])
+			if err != nil {
+				c.replyError(err.Error())
+				return true
+			}
+			c.replyList(fmt.Sprintf("Bans in %s:", r.Name), r.listBans())
+			return true
+		}
+		d, err := parseOptionalDuration(fields, 3)
+		if err != nil {
+			c.replyError(err.Error())
+			return true
+		}
+		err = c.Ban(fields[1], fields[2], d)
+		if err != nil {
+			c.replyError(err.Error())
+		}
+	case "/unban":
+		if len(fields) != 3 {
+			c.replyError("Usage is /unban <room> <mask>")
+			return true
+		}
+		err := c.Unban(fields[1], fields[2])
+		if err != nil {
+			c.replyError(err.Error())
+		}
+	case "/mute":
+		if len(fields) < 2 || len(fields) > 4 {
+			c.replyError("Usage is /mute <room> [user|mask [duration]]")
+			return true
+		}
+		if len(fields) == 2 {
+			r, _, err := c.opRoom(fields[1])
+			if err != nil {
+				c.replyError(err.Error())
+				return true
+			}
+			c.replyList(fmt.Sprintf("Mutes in %s:", r.Name), r.listMutes())
+			return true
+		}
+		d, err := parseOptionalDuration(fields, 3)
+		if err != nil {
+			c.replyError(err.Error())
+			return true
+		}
+		err = c.Mute(fields[1], fields[2], d)
+		if err != nil {
+			c.replyError(err.Error())
+		}
+	case "/unmute":
+		if len(fields) != 3 {
+			c.replyError("Usage is /unmute <room> <user|mask>")
+			return true
+		}
+		err := c.Unmute(fields[1], fields[2])
+		if err != nil {
+			c.replyError(err.Error())
+		}
+	case "/topic":
+		if len(fields) < 2 {
+			c.replyError("Usage is /topic <room> [topic]")
+			return true
+		}
+		err := c.Topic(fields[1], trailingText(input, 2))
+		if err != nil {
+			c.replyError(err.Error())
+		}
+	case "/describe":
+		if len(fields) < 3 {
+			c.replyError("Usage is /describe <room> <description>")
+			return true
+		}
+		err := c.Describe(fields[1], trailingText(input, 2))
+		if err != nil {
+			c.replyError(err.Error())
+		}
+	case "/roominfo":
+		if len(fields) != 2 {
+			c.replyError("Usage is /roominfo <room>")
+			return true
+		}
+		err := c.RoomInfo(fields[1])
+		if err != nil {
+			c.replyError(err.Error())
+		}
+	case "/mode":
+		if len(fields) < 2 || len(fields) > 4 {
+			c.replyError("Usage is /mode <room> [+mode|-mode] [key]")
+			return true
+		}
+		fields = append(fields, "", "")
+		err := c.Mode(fields[1], fields[2], fields[3])
+		if err != nil {
+			c.replyError(err.Error())
+		}
+	case "/invite":
+		if len(fields) != 3 {
+			c.replyError("Usage is /invite <room> <user>")
+			return true
+		}
+		err := c.Invite(fields[1], fields[2])
+		if err != nil {
+			c.replyError(err.Error())
+		}
+	case "/admin":
+		c.handleAdmin(input, fields)
+	case "/proto":
+		if len(fields) != 2 {
+			c.replyError("Usage is /proto <text|json>")
+			return true
+		}
+		proto, ok := protocols[fields[1]]
+		if !ok {
+			c.replyError("Unknown protocol, use text or json")
 			return true
 		}
+		atomic.StoreInt32(&c.proto, proto)
+		c.replyf("Protocol set to %s", fields[1])
+	case "/set":
+		c.handleSet(input, fields)
+	case "/ping":
+		c.write(&Message{Kind: KindPong, Body: strings.Join(fields[1:], " ")})
+	case "/pong":
+		// Any input answers a PING, reading it was enough.
 	default:
-		fmt.Fprintf(c.c, "Unknown command: %s\n", fields[0])
+		c.replyError("Unknown command: " + fields[0])
 	}
 	return true
 }
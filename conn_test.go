@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTrailingText(t *testing.T) {
+	tests := []struct {
+		input string
+		n     int
+		want  string
+	}{
+		{"/say lobby hello  world", 2, "hello  world"},
+		{"/msg bob b", 2, "b"},
+		{"/say  lobby\tspaced ", 2, "spaced "},
+		{"/say lobby", 2, ""},
+	}
+	for _, tt := range tests {
+		if got := trailingText(tt.input, tt.n); got != tt.want {
+			t.Errorf("trailingText(%q, %d) = %q, want %q", tt.input, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestMsg(t *testing.T) {
+	s := NewServer()
+	alice := &Conn{id: 1, server: s, username: "alice", outputChan: make(chan *Message, 1)}
+	bob := &Conn{id: 2, server: s, username: "bob", outputChan: make(chan *Message, 1)}
+	for _, c := range []*Conn{alice, bob} {
+		if err := s.usernames.addUsername(c.id, c.username); err != nil {
+			t.Fatal(err)
+		}
+		s.conns.add(c)
+	}
+
+	if err := alice.Msg("bob", "hi there"); err != nil {
+		t.Fatal(err)
+	}
+	if got := (<-bob.outputChan).render(protoText, defaultDisplayPrefs); !strings.HasSuffix(got, " *alice*: hi there\n") {
+		t.Fatalf("unexpected private message for bob: %q", got)
+	}
+	if got := (<-alice.outputChan).render(protoText, defaultDisplayPrefs); !strings.HasSuffix(got, " -> *bob*: hi there\n") {
+		t.Fatalf("unexpected echo for alice: %q", got)
+	}
+
+	if err := alice.Msg("carol", "hi"); err == nil {
+		t.Fatal("expected an error messaging a user that does not exist")
+	}
+}
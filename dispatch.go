@@ -0,0 +1,85 @@
+package main
+
+import "sync"
+
+// inlineFanout is the largest room whose messages are delivered by the goroutine broadcasting them.
+// Bigger rooms hand their messages to a dispatcher so the sender doesn't spend its time on the fan-out.
+const inlineFanout = 64
+
+// maxDispatchQueue is how many messages a room's dispatcher holds before broadcasts wait for it to catch up.
+const maxDispatchQueue = 1024
+
+// dispatch is a message waiting to be delivered to the connections that were in the room when it was sent.
+type dispatch struct {
+	m       *Message
+	members []*Conn
+	slow    SlowConsumerPolicy
+}
+
+// dispatcher delivers the messages of a room in the order they were sent.
+// Its goroutine is only running while there are messages to deliver.
+type dispatcher struct {
+	sync.Mutex
+	// drained is signalled whenever the goroutine takes the queue, so full broadcasts can continue.
+	drained *sync.Cond
+	queue   []dispatch
+	running bool
+	done    sync.WaitGroup
+}
+
+func newDispatcher() *dispatcher {
+	d := &dispatcher{}
+	d.drained = sync.NewCond(&d.Mutex)
+	return d
+}
+
+// send delivers a message to the members. Small rooms are delivered to right away unless earlier
+// messages are still queued, otherwise the message is queued for the dispatcher's goroutine.
+func (d *dispatcher) send(x dispatch) {
+	d.Lock()
+	defer d.Unlock()
+	if !d.running && len(x.members) <= inlineFanout {
+		x.deliver()
+		return
+	}
+	for len(d.queue) >= maxDispatchQueue {
+		d.drained.Wait()
+	}
+	d.queue = append(d.queue, x)
+	if !d.running {
+		d.running = true
+		d.done.Add(1)
+		go d.run()
+	}
+}
+
+// run delivers queued messages until the queue is empty.
+func (d *dispatcher) run() {
+	defer d.done.Done()
+	for {
+		d.Lock()
+		batch := d.queue
+		d.queue = nil
+		if len(batch) == 0 {
+			d.running = false
+			d.Unlock()
+			return
+		}
+		d.drained.Broadcast()
+		d.Unlock()
+		for _, x := range batch {
+			x.deliver()
+		}
+	}
+}
+
+// wait blocks until every queued message has been delivered.
+func (d *dispatcher) wait() {
+	d.done.Wait()
+}
+
+func (x dispatch) deliver() {
+	for _, c := range x.members {
+		c.deliver(x.m, x.slow)
+	}
+}
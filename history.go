@@ -0,0 +1,48 @@
+package main
+
+import "sync"
+
+// history is a fixed size ring buffer of the most recent messages of a room.
+type history struct {
+	sync.Mutex
+	messages []*Message
+	start    int
+	count    int
+}
+
+// newHistory creates a ring buffer that holds up to size messages. A size of zero or less disables it.
+func newHistory(size int) *history {
+	if size < 0 {
+		size = 0
+	}
+	return &history{
+		messages: make([]*Message, size),
+	}
+}
+
+// add stores a message, overwriting the oldest message if the buffer is full.
+func (h *history) add(m *Message) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.messages) == 0 {
+		return
+	}
+	end := (h.start + h.count) % len(h.messages)
+	h.messages[end] = m
+	if h.count < len(h.messages) {
+		h.count++
+		return
+	}
+	h.start = (h.start + 1) % len(h.messages)
+}
+
+// last returns the stored messages from oldest to newest.
+func (h *history) last() []*Message {
+	h.Lock()
+	defer h.Unlock()
+	list := make([]*Message, 0, h.count)
+	for i := 0; i < h.count; i++ {
+		list = append(list, h.messages[(h.start+i)%len(h.messages)])
+	}
+	return list
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// The defaults of the keep alive options.
+const (
+	defaultPingTimeout  = 30 * time.Second
+	defaultWriteTimeout = 10 * time.Second
+	defaultTCPKeepAlive = 15 * time.Second
+)
+
+// idleCheckInterval is how often connections are checked while IdleTimeout is 0, so they start being
+// pinged if it is turned on by a reload.
+const idleCheckInterval = time.Minute
+
+// startIdleTimer starts checking if the connection has gone quiet, see checkIdle.
+func (c *Conn) startIdleTimer() {
+	// The timer is stored before it is started so checkIdle always finds it.
+	c.idleTimer = time.AfterFunc(time.Hour, c.checkIdle)
+	c.idleTimer.Stop()
+	c.idleTimer.Reset(c.idleCheckAfter(c.server.options()))
+}
+
+// resetIdleTimer re-arms the idle timer unless the connection has been closed.
+func (c *Conn) resetIdleTimer(d time.Duration) {
+	c.idleLock.Lock()
+	defer c.idleLock.Unlock()
+	if !c.idleStopped {
+		c.idleTimer.Reset(d)
+	}
+}
+
+// stopIdleTimer stops the idle timer for good, checkIdle can still be running but won't re-arm it.
+func (c *Conn) stopIdleTimer() {
+	c.idleLock.Lock()
+	defer c.idleLock.Unlock()
+	c.idleStopped = true
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+}
+
+// idleCheckAfter returns how long to wait before the first check of a connection.
+func (c *Conn) idleCheckAfter(opts Options) time.Duration {
+	if opts.IdleTimeout <= 0 {
+		return idleCheckInterval
+	}
+	return opts.IdleTimeout
+}
+
+// checkIdle is run by the idle timer. A connection that hasn't sent any input for IdleTimeout is sent
+// a PING, and it is disconnected if it still hasn't sent anything PingTimeout after that.
+// Any input counts as an answer, clients are expected to send /pong with the token of the PING.
+func (c *Conn) checkIdle() {
+	opts := c.server.options()
+	if opts.IdleTimeout <= 0 {
+		c.resetIdleTimer(idleCheckInterval)
+		return
+	}
+	lastInput := atomic.LoadInt64(&c.lastInput)
+	pinged := atomic.LoadInt64(&c.pinged)
+	now := time.Now()
+	if pinged > lastInput {
+		// The connection hasn't answered the last PING.
+		waited := now.Sub(time.Unix(0, pinged))
+		if waited >= opts.PingTimeout {
+			c.disconnect("timed out")
+			return
+		}
+		c.resetIdleTimer(opts.PingTimeout - waited)
+		return
+	}
+	idle := now.Sub(time.Unix(0, lastInput))
+	if idle < opts.IdleTimeout {
+		c.resetIdleTimer(opts.IdleTimeout - idle)
+		return
+	}
+	ping := &Message{Kind: KindPing}
+	ping.stamp()
+	ping.Body = fmt.Sprint(ping.ID)
+	atomic.StoreInt64(&c.pinged, now.UnixNano())
+	c.send(ping)
+	c.resetIdleTimer(opts.PingTimeout)
+}
+
+// setWriteDeadline limits how long the next write to the connection can take to WriteTimeout.
+func (c *Conn) setWriteDeadline() {
+	d, ok := c.c.(interface{ SetWriteDeadline(time.Time) error })
+	if !ok {
+		return
+	}
+	timeout := c.server.options().WriteTimeout
+	if timeout <= 0 {
+		d.SetWriteDeadline(time.Time{})
+		return
+	}
+	d.SetWriteDeadline(time.Now().Add(timeout))
+}
+
+// setKeepAlive applies TCPKeepAlive to an accepted connection so the operating system notices
+// clients that have gone away without closing their connection.
+func (s *Server) setKeepAlive(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	period := s.options().TCPKeepAlive
+	tcp.SetKeepAlive(period > 0)
+	if period > 0 {
+		tcp.SetKeepAlivePeriod(period)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readUntil reads lines until one has the prefix.
+func readUntil(t *testing.T, r *bufio.Reader, prefix string) string {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error waiting for %q: %s", prefix, err)
+		}
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := NewServer()
+	s.IdleTimeout = 50 * time.Millisecond
+	s.PingTimeout = 50 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.Serve(ln)
+
+	quiet, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer quiet.Close()
+	quietReader := bufio.NewReader(quiet)
+	quiet.Write([]byte("/ping hello\n"))
+	if line := readUntil(t, quietReader, "PONG"); line != "PONG hello\n" {
+		t.Fatalf("expected the token in the PONG, got %q", line)
+	}
+
+	watcher, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	left := make(chan string, 1)
+	go func() {
+		// The watcher answers its PINGs so it stays connected.
+		r := bufio.NewReader(watcher)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(left)
+				return
+			}
+			if strings.HasPrefix(line, "PING ") {
+				watcher.Write([]byte("/pong " + line[len("PING "):]))
+			}
+			if strings.Contains(line, "lobby server: Anonymous1 has left") {
+				left <- line
+				return
+			}
+		}
+	}()
+
+	// Answering the PING keeps the connection open until the next one.
+	ping := readUntil(t, quietReader, "PING ")
+	quiet.Write([]byte("/pong " + ping[len("PING "):]))
+	readUntil(t, quietReader, "PING ")
+
+	select {
+	case line := <-left:
+		if !strings.Contains(line, "(timed out)") {
+			t.Fatalf("expected the room to be told the connection timed out, got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to time out")
+	}
+	for {
+		if _, err := quietReader.ReadString('\n'); err != nil {
+			break
+		}
+	}
+}
+
+func TestIdleTimerStopsOnClose(t *testing.T) {
+	s := NewServer()
+	s.IdleTimeout = time.Hour
+	c := &Conn{id: 1, server: s, lastInput: time.Now().UnixNano()}
+	c.startIdleTimer()
+	c.stopIdleTimer()
+	// A check that was already running when the connection closed must not re-arm the timer.
+	c.checkIdle()
+	if c.idleTimer.Stop() {
+		t.Fatal("expected the idle timer to stay stopped after the connection closed")
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	s := NewServer()
+	s.WriteTimeout = 10 * time.Millisecond
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &Conn{id: 1, c: server, server: s}
+	// Nothing reads from the client end of the pipe so the write can't finish.
+	c.reply("hello")
+	if reason, _ := c.quitReason.Load().(string); reason != "timed out" {
+		t.Fatalf("expected the connection to be disconnected for timing out, got %q", reason)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// The defaults of the connection limit options.
+const (
+	defaultIPv4PrefixLen = 32
+	defaultIPv6PrefixLen = 64
+	defaultAcceptBurst   = 10
+)
+
+// rejectWriteTimeout limits how long telling a rejected connection why can take.
+const rejectWriteTimeout = time.Second
+
+// The reasons sent to connections that are rejected by the limits.
+const (
+	serverFullText      = "The server is full, try again later"
+	tooManyFromIPText   = "Too many connections from your address"
+	acceptRateLimitText = "Too many new connections, try again later"
+)
+
+// connLimiter counts the live connections, in total and per network, and refills the token bucket
+// used to limit how fast new connections are accepted.
+type connLimiter struct {
+	sync.Mutex
+	total int
+	perIP map[string]int
+	// tokens is the number of connections that can be accepted right now, it is refilled
+	// at AcceptRate per second up to AcceptBurst.
+	tokens float64
+	filled time.Time
+}
+
+// ipKey returns the network that a remote address counts towards for MaxConnsPerIP, which is the address
+// masked to IPv4PrefixLen or IPv6PrefixLen bits. It returns an empty string for addresses without an IP,
+// such as unix sockets, which only count towards MaxConns.
+func ipKey(remoteAddr string, opts Options) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(opts.IPv4PrefixLen, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(opts.IPv6PrefixLen, 128)).String()
+}
+
+// admit checks a new connection against the limits. If it is allowed it is counted and the key it counts
+// towards is returned, release must be called with the key once it is closed.
+// Otherwise the reason it was rejected is returned.
+func (cl *connLimiter) admit(remoteAddr string, opts Options) (key string, reason string) {
+	cl.Lock()
+	defer cl.Unlock()
+	if opts.MaxConns > 0 && cl.total >= opts.MaxConns {
+		return "", serverFullText
+	}
+	key = ipKey(remoteAddr, opts)
+	if key != "" && opts.MaxConnsPerIP > 0 && cl.perIP[key] >= opts.MaxConnsPerIP {
+		return "", tooManyFromIPText
+	}
+	if opts.AcceptRate > 0 {
+		now := time.Now()
+		burst := float64(opts.AcceptBurst)
+		if burst < 1 {
+			burst = 1
+		}
+		if cl.filled.IsZero() {
+			cl.tokens = burst
+		} else {
+			cl.tokens += now.Sub(cl.filled).Seconds() * float64(opts.AcceptRate)
+			if cl.tokens > burst {
+				cl.tokens = burst
+			}
+		}
+		cl.filled = now
+		if cl.tokens < 1 {
+			return "", acceptRateLimitText
+		}
+		cl.tokens--
+	}
+	cl.total++
+	if key != "" {
+		cl.perIP[key]++
+	}
+	return key, ""
+}
+
+// release stops counting a connection that was admitted with the key.
+func (cl *connLimiter) release(key string) {
+	cl.Lock()
+	defer cl.Unlock()
+	cl.total--
+	if key == "" {
+		return
+	}
+	cl.perIP[key]--
+	if cl.perIP[key] <= 0 {
+		delete(cl.perIP, key)
+	}
+}
+
+// reject tells a connection why it isn't being accepted, in the protocol of the listener it came from, and closes it.
+func (s *Server) reject(conn io.ReadWriteCloser, remoteAddr string, l *Listener, reason string) {
+	log.Printf("rejected connection from %s: %s\n", remoteAddr, reason)
+	proto := protoText
+	if l != nil && l.JSON {
+		proto = protoJSON
+	}
+	if d, ok := conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		d.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	}
+	m := &Message{Kind: KindError, Body: reason}
+	io.WriteString(conn, m.render(proto, defaultDisplayPrefs))
+	conn.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIPKey(t *testing.T) {
+	opts := Options{IPv4PrefixLen: 24, IPv6PrefixLen: 64}
+	for _, tt := range []struct {
+		addr string
+		want string
+	}{
+		{"192.168.1.10:4000", "192.168.1.0"},
+		{"192.168.1.200:4001", "192.168.1.0"},
+		{"[2001:db8::1]:4000", "2001:db8::"},
+		{"[2001:db8:0:0:ffff::1]:4000", "2001:db8::"},
+		{"@", ""},
+		{"", ""},
+	} {
+		if got := ipKey(tt.addr, opts); got != tt.want {
+			t.Errorf("ipKey(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	cl := &connLimiter{perIP: make(map[string]int)}
+	opts := Options{MaxConns: 3, MaxConnsPerIP: 2, IPv4PrefixLen: 32, IPv6PrefixLen: 64}
+	key, reason := cl.admit("10.0.0.1:1", opts)
+	if reason != "" {
+		t.Fatalf("expected the first connection to be admitted, got %q", reason)
+	}
+	if _, reason := cl.admit("10.0.0.1:2", opts); reason != "" {
+		t.Fatalf("expected the second connection to be admitted, got %q", reason)
+	}
+	if _, reason := cl.admit("10.0.0.1:3", opts); reason != tooManyFromIPText {
+		t.Fatalf("expected a third connection from the address to be rejected, got %q", reason)
+	}
+	if _, reason := cl.admit("@", opts); reason != "" {
+		t.Fatalf("expected a unix socket connection to be admitted, got %q", reason)
+	}
+	if _, reason := cl.admit("10.0.0.2:1", opts); reason != serverFullText {
+		t.Fatalf("expected a connection to a full server to be rejected, got %q", reason)
+	}
+	cl.release(key)
+	if _, reason := cl.admit("10.0.0.1:4", opts); reason != "" {
+		t.Fatalf("expected a connection to be admitted once another is closed, got %q", reason)
+	}
+
+	cl = &connLimiter{perIP: make(map[string]int)}
+	opts = Options{AcceptRate: 1, AcceptBurst: 2}
+	for i := 0; i < 2; i++ {
+		if _, reason := cl.admit("10.0.0.1:1", opts); reason != "" {
+			t.Fatalf("expected connection %d of the burst to be admitted, got %q", i, reason)
+		}
+	}
+	if _, reason := cl.admit("10.0.0.1:1", opts); reason != acceptRateLimitText {
+		t.Fatalf("expected a connection over the accept rate to be rejected, got %q", reason)
+	}
+	if cl.total != 2 {
+		t.Errorf("expected rejected connections not to be counted, got %d", cl.total)
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	s := NewServer()
+	s.MaxConnsPerIP = 1
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.Serve(ln)
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	r := bufio.NewReader(first)
+	readUntil(t, r, "Welcome")
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	line, err := bufio.NewReader(second).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != tooManyFromIPText+"\n" {
+		t.Fatalf("expected the second connection to be told why it was rejected, got %q", line)
+	}
+	if id := atomic.LoadInt64(&s.lastID); id != 1 {
+		t.Errorf("expected the rejected connection not to be given an id, got %d ids", id)
+	}
+
+	first.Close()
+	// The address can connect again once its connection has closed.
+	for {
+		third, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := bufio.NewReader(third).ReadString('\n')
+		third.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != tooManyFromIPText+"\n" {
+			break
+		}
+	}
+}
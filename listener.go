@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+// Listener is an address the server accepts connections on and the policy for the connections accepted there.
+// A server can serve any number of listeners, they all share the same rooms and usernames.
+type Listener struct {
+	// Network is "tcp" or "unix", "tcp" is used when it is empty.
+	Network string
+	Addr    string
+	// TLSCertFile and TLSKeyFile enable TLS on the listener when they are set.
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion uint16
+	// JSON starts connections with the JSON protocol instead of text.
+	JSON bool
+	// RequireLogin stops guests on this listener from chatting until they log in, even if the server allows guests.
+	RequireLogin bool
+	// PeerUsers maps user ids to usernames for unix listeners. Connections from a process running as one of
+	// the user ids are logged in as its username without a password, instead of starting as a guest.
+	PeerUsers map[uint32]string
+}
+
+// listenerNetworks are the networks a Listener can use.
+var listenerNetworks = map[string]bool{
+	"tcp":  true,
+	"unix": true,
+}
+
+// network returns the network of the listener, defaulting to tcp.
+func (l *Listener) network() string {
+	if l.Network == "" {
+		return "tcp"
+	}
+	return l.Network
+}
+
+// listen opens the listener, using TLS if it has a certificate.
+func (s *Server) listen(l *Listener) (net.Listener, error) {
+	network := l.network()
+	if !listenerNetworks[network] {
+		return nil, fmt.Errorf("unknown network %q, use tcp or unix", network)
+	}
+	if network == "unix" {
+		removeStaleSocket(l.Addr)
+	}
+	if l.TLSCertFile == "" {
+		return net.Listen(network, l.Addr)
+	}
+	certs := &certReloader{}
+	err := certs.load(l.TLSCertFile, l.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := tls.Listen(network, l.Addr, &tls.Config{
+		GetCertificate: certs.getCertificate,
+		MinVersion:     l.TLSMinVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.listenerCerts.add(certs)
+	return ln, nil
+}
+
+// removeStaleSocket removes a unix socket left behind by a server that didn't shut down cleanly,
+// which would stop a new listener from using the path. Sockets that are still accepting connections are kept.
+func removeStaleSocket(path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	log.Printf("removing stale unix socket %s\n", path)
+	os.Remove(path)
+}
+
+// ListenAndServeOn listens on the listener's address and spawns connections in their own goroutine,
+// applying the listener's policy to each of them.
+func (s *Server) ListenAndServeOn(l Listener) error {
+	ln, err := s.listen(&l)
+	if err != nil {
+		return err
+	}
+	s.peerNames.add(l.PeerUsers)
+	defer s.peerNames.remove(l.PeerUsers)
+	if l.TLSCertFile != "" {
+		log.Printf("Listening for TLS on %s %s\n", l.network(), l.Addr)
+	} else {
+		log.Printf("Listening on %s %s\n", l.network(), l.Addr)
+	}
+	return s.serve(ln, &l)
+}
+
+// peerNameList counts the listeners mapping a user id to each username in PeerUsers.
+type peerNameList struct {
+	sync.RWMutex
+	names map[string]int
+}
+
+// add reserves the usernames of a listener's PeerUsers.
+func (pl *peerNameList) add(users map[uint32]string) {
+	pl.Lock()
+	defer pl.Unlock()
+	for _, name := range users {
+		pl.names[name]++
+	}
+}
+
+// remove releases the usernames of a listener's PeerUsers once it has stopped.
+func (pl *peerNameList) remove(users map[uint32]string) {
+	pl.Lock()
+	defer pl.Unlock()
+	for _, name := range users {
+		if pl.names[name]--; pl.names[name] <= 0 {
+			delete(pl.names, name)
+		}
+	}
+}
+
+// has returns true if a listener maps a user id to the username.
+func (pl *peerNameList) has(name string) bool {
+	pl.RLock()
+	defer pl.RUnlock()
+	return pl.names[name] > 0
+}
+
+// peerIdentity returns the user id of the process on the other end of a connection to a unix listener.
+// ok is false for other connections, or if the user id can't be read.
+func peerIdentity(c io.ReadWriteCloser) (uid uint32, ok bool) {
+	if tc, isTLS := c.(*tls.Conn); isTLS {
+		c = tc.NetConn()
+	}
+	uc, isUnix := c.(*net.UnixConn)
+	if !isUnix {
+		return 0, false
+	}
+	uid, err := peerUID(uc)
+	if err != nil {
+		log.Printf("error reading the user id of a unix socket connection: %s\n", err)
+		return 0, false
+	}
+	return uid, true
+}
+
+// certList holds the certificates of the listeners started with ListenAndServeOn so they can be reloaded.
+type certList struct {
+	sync.Mutex
+	list []*certReloader
+}
+
+// add adds the certificate of a listener.
+func (cl *certList) add(cr *certReloader) {
+	cl.Lock()
+	defer cl.Unlock()
+	cl.list = append(cl.list, cr)
+}
+
+// reload reads all the certificate and key files again, it returns the first error.
+func (cl *certList) reload() error {
+	cl.Lock()
+	defer cl.Unlock()
+	var err error
+	for _, cr := range cl.list {
+		e := cr.reload()
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// len returns the number of certificates.
+func (cl *certList) len() int {
+	cl.Lock()
+	defer cl.Unlock()
+	return len(cl.list)
+}
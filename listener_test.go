@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialRetry dials until the listener has started.
+func dialRetry(t *testing.T, network, addr string) net.Conn {
+	for i := 0; ; i++ {
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			return conn
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListenerPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tbit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "tbit.sock")
+
+	s := NewServer()
+	go s.ListenAndServeOn(Listener{Network: "unix", Addr: sock, JSON: true, RequireLogin: true})
+	conn := dialRetry(t, "unix", sock)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// The welcome and the login notice are sent in JSON without asking for it.
+	for _, want := range []string{"reply", "error"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m jsonMessage
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("expected JSON output, got %q", line)
+		}
+		if m.Type != want {
+			t.Fatalf("expected a %s, got %+v", want, m)
+		}
+		if want == "error" && m.Text != loginRequiredText {
+			t.Fatalf("expected guests to need to log in, got %q", m.Text)
+		}
+	}
+	if got := s.rooms.get("lobby").listUsernames(s.usernames); len(got) != 0 {
+		t.Fatalf("expected the guest to wait for a login before joining the lobby, got %v", got)
+	}
+}
+
+func TestPeerUsers(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	dir, err := ioutil.TempDir("", "tbit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "tbit.sock")
+
+	s := NewServer()
+	s.RequireLogin = true
+	// Only admins are shown addresses by /whois, mapping a user id to an admin makes it one.
+	s.Admins = []string{"robot"}
+	go s.ListenAndServeOn(Listener{Network: "unix", Addr: sock, PeerUsers: map[uint32]string{uint32(os.Getuid()): "robot"}})
+	conn := dialRetry(t, "unix", sock)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	conn.Write([]byte("/whois robot\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(line, loginRequiredText) {
+			t.Fatal("expected the connection to be logged in by its user id")
+		}
+		if strings.Contains(line, "unix uid ") {
+			break
+		}
+	}
+	if got, want := s.rooms.get("lobby").listUsernames(s.usernames), []string{"robot"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the connection to join the lobby as %v, got %v", want, got)
+	}
+}
@@ -1,59 +1,525 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pelletier/go-toml"
 )
 
-// TODO(pmo): use benchmarks to tune this value or make it a config variable.
-const outputBufSize = 100
-
 type settings struct {
-	Host    string
-	Port    string
-	LogFile string
+	Host         string
+	Port         string
+	LogFile      string
+	HistorySize  int
+	AccountsFile string
+	RequireLogin bool
+	// Port can be set to "" to only listen for TLS connections.
+	TLSPort       string
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion string
+	// HTTPPort serves WebSocket connections for browser clients on /ws when set.
+	// WebSocketOrigins are the other sites whose pages can connect to it.
+	HTTPPort         string
+	WebSocketOrigins []string
+	// SlowConsumer is the server's policy for connections that aren't keeping up, RoomSlowConsumer overrides it per room.
+	SlowConsumer     slowConsumerSettings
+	RoomSlowConsumer map[string]slowConsumerSettings
+	// ShutdownMessage is announced to every room on SIGINT or SIGTERM, then connections have
+	// ShutdownTimeout to receive their remaining messages before they are closed.
+	ShutdownMessage string
+	ShutdownTimeout string
+	// OutputBufferSize is the number of messages queued for each connection before the slow consumer policy is used.
+	OutputBufferSize int
+	// DefaultRoom is the room connections join when they connect.
+	DefaultRoom string
+	// WelcomeText is sent to new connections, {username} is replaced with their username.
+	WelcomeText string
+	// HelpText is the reply to /help.
+	HelpText string
+	// IdleTimeout, PingTimeout, WriteTimeout and TCPKeepAlive detect dead connections, see Options.
+	IdleTimeout  string
+	PingTimeout  string
+	WriteTimeout string
+	TCPKeepAlive string
+	// MaxConns, MaxConnsPerIP, IPv4PrefixLen, IPv6PrefixLen, AcceptRate and AcceptBurst limit connections, see Options.
+	MaxConns      int
+	MaxConnsPerIP int
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+	AcceptRate    int
+	AcceptBurst   int
+	// Admins are the registered accounts that are admins, AdminPassword lets anyone who knows it become one.
+	// Their actions are written to AuditLogFile.
+	Admins        []string
+	AdminPassword string
+	AuditLogFile  string
+	// Listener adds listeners, each with their own policy, to the ones set by Port and TLSPort.
+	Listener []listenerSettings
+	// Room declares the permanent rooms, other rooms are removed once they have been empty for EmptyRoomTimeout.
+	Room             []roomSettings
+	EmptyRoomTimeout string
+}
+
+// roomSettings is how a permanent Room is written in the config file.
+type roomSettings struct {
+	Name        string
+	Topic       string
+	Description string
+	// Modes are the modes the room starts with, such as topic, private or invite. The key mode is set by Key.
+	Modes []string
+	Key   string
+}
+
+// permanentRoom validates the settings and returns the PermanentRoom they describe.
+func (rs roomSettings) permanentRoom() (PermanentRoom, error) {
+	p := PermanentRoom{Name: rs.Name, Topic: rs.Topic, Description: rs.Description}
+	if rs.Name == "" || strings.ContainsAny(rs.Name, " \t") {
+		return p, fmt.Errorf("Name must be a room name without spaces, got %q", rs.Name)
+	}
+	for _, mode := range rs.Modes {
+		if mode == "key" {
+			return p, errors.New("the key mode is set with Key")
+		}
+		err := p.modes.set(mode, true, "")
+		if err != nil {
+			return p, err
+		}
+	}
+	if rs.Key != "" {
+		p.modes.set("key", true, rs.Key)
+	}
+	return p, nil
+}
+
+// permanentRooms validates the Room settings and returns the permanent rooms they describe.
+func (s *settings) permanentRooms() ([]PermanentRoom, error) {
+	var list []PermanentRoom
+	seen := make(map[string]bool)
+	for i, rs := range s.Room {
+		p, err := rs.permanentRoom()
+		if err != nil {
+			return nil, fmt.Errorf("room %d: %s", i+1, err)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("room %d: %s is declared more than once", i+1, p.Name)
+		}
+		seen[p.Name] = true
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// listenerSettings is how a Listener is written in the config file.
+type listenerSettings struct {
+	Network       string
+	Addr          string
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion string
+	// Proto is the protocol connections start with, text or json.
+	Proto        string
+	RequireLogin bool
+	// PeerUsers maps the user ids of local processes to the usernames they log in as on unix listeners.
+	PeerUsers map[string]string
+}
+
+// listener validates the settings and returns the Listener they describe.
+func (ls listenerSettings) listener() (Listener, error) {
+	l := Listener{
+		Network:      ls.Network,
+		Addr:         ls.Addr,
+		TLSCertFile:  ls.TLSCertFile,
+		TLSKeyFile:   ls.TLSKeyFile,
+		RequireLogin: ls.RequireLogin,
+	}
+	if !listenerNetworks[l.network()] {
+		return l, fmt.Errorf("unknown network %q, use tcp or unix", ls.Network)
+	}
+	if ls.Addr == "" {
+		return l, errors.New("Addr must be set")
+	}
+	if (ls.TLSCertFile == "") != (ls.TLSKeyFile == "") {
+		return l, errors.New("TLSCertFile and TLSKeyFile must both be set to use TLS")
+	}
+	if ls.TLSMinVersion != "" {
+		v, err := parseTLSVersion(ls.TLSMinVersion)
+		if err != nil {
+			return l, err
+		}
+		l.TLSMinVersion = v
+	}
+	if ls.Proto != "" {
+		proto, ok := protocols[ls.Proto]
+		if !ok {
+			return l, fmt.Errorf("unknown protocol %q, use text or json", ls.Proto)
+		}
+		l.JSON = proto == protoJSON
+	}
+	if len(ls.PeerUsers) > 0 && l.network() != "unix" {
+		return l, errors.New("PeerUsers can only be used by unix listeners")
+	}
+	for id, name := range ls.PeerUsers {
+		uid, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return l, fmt.Errorf("invalid user id %q in PeerUsers", id)
+		}
+		if name == "" || name == "server" || strings.HasPrefix(name, guestNamePrefix) || strings.ContainsAny(name, " \t") {
+			return l, fmt.Errorf("invalid username %q in PeerUsers", name)
+		}
+		if l.PeerUsers == nil {
+			l.PeerUsers = make(map[uint32]string)
+		}
+		l.PeerUsers[uint32(uid)] = name
+	}
+	return l, nil
+}
+
+// listeners validates the Listener settings and returns the listeners they describe.
+func (s *settings) listeners() ([]Listener, error) {
+	var list []Listener
+	for i, ls := range s.Listener {
+		l, err := ls.listener()
+		if err != nil {
+			return nil, fmt.Errorf("listener %d: %s", i+1, err)
+		}
+		list = append(list, l)
+	}
+	return list, nil
 }
 
+// readConfig reads a TOML config file on top of the current settings.
+// Anything not set in the file keeps its current value.
 func (s *settings) readConfig(r io.Reader) error {
-	d := toml.NewDecoder(r)
-	return d.Decode(s)
+	file, err := toml.LoadReader(r)
+	if err != nil {
+		return err
+	}
+	// Decoding replaces the whole struct, so the file is merged onto the current settings
+	// before decoding to keep the defaults of anything the file doesn't set.
+	b, err := toml.Marshal(*s)
+	if err != nil {
+		return err
+	}
+	current, err := toml.LoadBytes(b)
+	if err != nil {
+		return err
+	}
+	mergeTrees(current, file)
+	return current.Unmarshal(s)
 }
 
-func main() {
-	config := settings{
-		Host:    "",
-		Port:    "9999",
-		LogFile: "tbit.log",
+// mergeTrees sets every value of src in dst, merging tables that are in both.
+// Keys are matched ignoring case since that is how they are decoded into structs.
+func mergeTrees(dst, src *toml.Tree) {
+	for _, key := range src.Keys() {
+		dstKey := key
+		for _, k := range dst.Keys() {
+			if strings.EqualFold(k, key) {
+				dstKey = k
+				break
+			}
+		}
+		value := src.GetPath([]string{key})
+		srcTree, srcIsTree := value.(*toml.Tree)
+		dstTree, dstIsTree := dst.GetPath([]string{dstKey}).(*toml.Tree)
+		if srcIsTree && dstIsTree {
+			mergeTrees(dstTree, srcTree)
+			continue
+		}
+		dst.SetPath([]string{dstKey}, value)
+	}
+}
+
+// slowConsumerPolicies validates the slow consumer settings and returns the server's policy and each room's policy.
+func (s *settings) slowConsumerPolicies() (SlowConsumerPolicy, map[string]SlowConsumerPolicy, error) {
+	server, err := s.SlowConsumer.policy(SlowConsumerPolicy{Timeout: defaultSlowConsumerTimeout})
+	if err != nil {
+		return server, nil, err
+	}
+	rooms := make(map[string]SlowConsumerPolicy)
+	for name, rs := range s.RoomSlowConsumer {
+		rooms[name], err = rs.policy(server)
+		if err != nil {
+			return server, nil, fmt.Errorf("room %s: %s", name, err)
+		}
+	}
+	return server, rooms, nil
+}
+
+// defaultSettings returns the settings used for anything the config file doesn't set.
+func defaultSettings() settings {
+	return settings{
+		Host:          "",
+		Port:          "9999",
+		LogFile:       "tbit.log",
+		HistorySize:   20,
+		AccountsFile:  "tbit.accounts",
+		TLSMinVersion: "1.2",
+		SlowConsumer: slowConsumerSettings{
+			Policy:  "block",
+			Timeout: "1s",
+		},
+		ShutdownMessage:  defaultShutdownMessage,
+		ShutdownTimeout:  "10s",
+		OutputBufferSize: defaultOutputBufferSize,
+		DefaultRoom:      defaultRoom,
+		WelcomeText:      defaultWelcomeText,
+		HelpText:         defaultHelpText,
+		IdleTimeout:      "0s",
+		PingTimeout:      defaultPingTimeout.String(),
+		WriteTimeout:     defaultWriteTimeout.String(),
+		TCPKeepAlive:     defaultTCPKeepAlive.String(),
+		IPv4PrefixLen:    defaultIPv4PrefixLen,
+		IPv6PrefixLen:    defaultIPv6PrefixLen,
+		AcceptBurst:      defaultAcceptBurst,
+		AuditLogFile:     "tbit-audit.log",
+		EmptyRoomTimeout: defaultEmptyRoomTimeout.String(),
+	}
+}
+
+// loadConfig reads the config file at path on top of the default settings.
+func loadConfig(path string) (settings, error) {
+	config := defaultSettings()
+	file, err := os.Open(path)
+	if err != nil {
+		return config, err
 	}
+	defer file.Close()
+	err = config.readConfig(file)
+	return config, err
+}
+
+// options returns the settings that can be changed while the server is running as its Options.
+func (s *settings) options() (Options, error) {
+	opts := Options{
+		HistorySize:      s.HistorySize,
+		RequireLogin:     s.RequireLogin,
+		ShutdownMessage:  s.ShutdownMessage,
+		OutputBufferSize: s.OutputBufferSize,
+		DefaultRoom:      s.DefaultRoom,
+		WelcomeText:      s.WelcomeText,
+		HelpText:         s.HelpText,
+		MaxConns:         s.MaxConns,
+		MaxConnsPerIP:    s.MaxConnsPerIP,
+		IPv4PrefixLen:    s.IPv4PrefixLen,
+		IPv6PrefixLen:    s.IPv6PrefixLen,
+		AcceptRate:       s.AcceptRate,
+		AcceptBurst:      s.AcceptBurst,
+		Admins:           s.Admins,
+		AdminPassword:    s.AdminPassword,
+		WebSocketOrigins: s.WebSocketOrigins,
+	}
+	if s.OutputBufferSize <= 0 {
+		return opts, fmt.Errorf("OutputBufferSize must be positive, got %d", s.OutputBufferSize)
+	}
+	if s.DefaultRoom == "" || strings.ContainsAny(s.DefaultRoom, " \t") {
+		return opts, fmt.Errorf("DefaultRoom must be a room name without spaces, got %q", s.DefaultRoom)
+	}
+	if s.MaxConns < 0 || s.MaxConnsPerIP < 0 || s.AcceptRate < 0 || s.AcceptBurst < 0 {
+		return opts, errors.New("MaxConns, MaxConnsPerIP, AcceptRate and AcceptBurst can't be negative")
+	}
+	for _, name := range s.Admins {
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return opts, fmt.Errorf("Admins must be usernames without spaces, got %q", name)
+		}
+	}
+	if s.IPv4PrefixLen < 0 || s.IPv4PrefixLen > 32 {
+		return opts, fmt.Errorf("IPv4PrefixLen must be between 0 and 32, got %d", s.IPv4PrefixLen)
+	}
+	if s.IPv6PrefixLen < 0 || s.IPv6PrefixLen > 128 {
+		return opts, fmt.Errorf("IPv6PrefixLen must be between 0 and 128, got %d", s.IPv6PrefixLen)
+	}
+	var err error
+	for _, d := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"IdleTimeout", s.IdleTimeout, &opts.IdleTimeout},
+		{"PingTimeout", s.PingTimeout, &opts.PingTimeout},
+		{"WriteTimeout", s.WriteTimeout, &opts.WriteTimeout},
+		{"TCPKeepAlive", s.TCPKeepAlive, &opts.TCPKeepAlive},
+		{"EmptyRoomTimeout", s.EmptyRoomTimeout, &opts.EmptyRoomTimeout},
+	} {
+		*d.dest, err = time.ParseDuration(d.value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s: %s", d.name, err)
+		}
+		if *d.dest < 0 {
+			return opts, fmt.Errorf("%s can't be negative, got %s", d.name, d.value)
+		}
+	}
+	if opts.IdleTimeout > 0 && opts.PingTimeout == 0 {
+		return opts, errors.New("PingTimeout must be set when IdleTimeout is")
+	}
+	opts.PermanentRooms, err = s.permanentRooms()
+	if err != nil {
+		return opts, err
+	}
+	opts.SlowConsumer, opts.RoomSlowConsumer, err = s.slowConsumerPolicies()
+	return opts, err
+}
+
+// shutdownTimeout returns how long connections have to receive their remaining messages when shutting down.
+func (s *settings) shutdownTimeout() (time.Duration, error) {
+	timeout, err := time.ParseDuration(s.ShutdownTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ShutdownTimeout: %s", err)
+	}
+	return timeout, nil
+}
 
-	file, err := os.Open("tbit.conf")
+// validate checks all the settings so a bad config file is rejected before anything is started or reloaded.
+func (s *settings) validate() error {
+	if s.Port == "" && s.TLSPort == "" && s.HTTPPort == "" && len(s.Listener) == 0 {
+		return errors.New("one of Port, TLSPort, HTTPPort or a Listener must be set")
+	}
+	_, err := s.listeners()
 	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Fatalf("error while reading config file: %s", err)
+		return err
+	}
+	if s.TLSPort != "" {
+		_, err := parseTLSVersion(s.TLSMinVersion)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = s.options()
+	if err != nil {
+		return err
+	}
+	_, err = s.shutdownTimeout()
+	return err
+}
+
+// openLogFile opens the log file for appending.
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// redactedValue replaces the values of secrets that are set in the output of -check-config.
+const redactedValue = "<redacted>"
+
+// redacted returns a copy of the settings with the admin password and room keys replaced by redactedValue,
+// like secretSettings keeps them out of the log on reload.
+func (s settings) redacted() settings {
+	if s.AdminPassword != "" {
+		s.AdminPassword = redactedValue
+	}
+	rooms := make([]roomSettings, len(s.Room))
+	for i, rs := range s.Room {
+		if rs.Key != "" {
+			rs.Key = redactedValue
 		}
-		log.Print("config file not found, using defaults")
+		rooms[i] = rs
+	}
+	if s.Room != nil {
+		s.Room = rooms
+	}
+	return s
+}
+
+// checkConfig writes the effective settings to w as a config file, or returns why they are invalid.
+// Secrets are redacted so the output can be shared.
+func checkConfig(config settings, w io.Writer) error {
+	err := config.validate()
+	if err != nil {
+		return err
+	}
+	b, err := toml.Marshal(config.redacted())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func main() {
+	cl, err := parseFlags(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	config, err := cl.loadSettings()
+	if err != nil {
+		log.Fatalf("fatal error reading config: %s", err)
 	}
-	if file != nil {
-		defer file.Close()
-		err := config.readConfig(file)
+	if cl.checkConfig {
+		err = checkConfig(config, os.Stdout)
 		if err != nil {
-			log.Fatalf("fatal error parsing config file: %s", err)
+			log.Fatalf("config is invalid: %s\n", err)
 		}
+		return
+	}
+	err = config.validate()
+	if err != nil {
+		log.Fatalf("Fatal error in config: %s\n", err)
 	}
 
-	file, err = os.OpenFile(config.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := openLogFile(config.LogFile)
 	if err != nil {
 		log.Fatalf("Fatal error opening log file: %s \n", err)
 	}
-	defer file.Close()
-	log.SetOutput(io.MultiWriter(file, os.Stderr))
+	log.SetOutput(io.MultiWriter(logFile, os.Stderr))
+	auditFile, err := openLogFile(config.AuditLogFile)
+	if err != nil {
+		log.Fatalf("Fatal error opening audit log file: %s \n", err)
+	}
 
 	s := NewServer()
+	s.SetAuditLog(auditFile)
 	s.Addr = net.JoinHostPort(config.Host, config.Port)
+	// The options were checked by validate.
+	s.Options, _ = config.options()
+	s.accounts, err = openAccountStore(config.AccountsFile)
+	if err != nil {
+		log.Fatalf("Fatal error reading accounts file: %s\n", err)
+	}
+
+	// The listeners were checked by validate.
+	listeners, _ := config.listeners()
+	// errs is buffered so the listeners can return after a shutdown without anyone receiving.
+	errs := make(chan error, 3+len(listeners))
+	if config.Port != "" {
+		go func() { errs <- s.ListenAndServe() }()
+	}
+	if config.TLSPort != "" {
+		s.TLSAddr = net.JoinHostPort(config.Host, config.TLSPort)
+		s.TLSCertFile = config.TLSCertFile
+		s.TLSKeyFile = config.TLSKeyFile
+		s.TLSMinVersion, _ = parseTLSVersion(config.TLSMinVersion)
+		go func() { errs <- s.ListenAndServeTLS() }()
+	}
+	if config.HTTPPort != "" {
+		s.HTTPAddr = net.JoinHostPort(config.Host, config.HTTPPort)
+		go func() { errs <- s.ListenAndServeHTTP() }()
+	}
+	for _, l := range listeners {
+		go func(l Listener) { errs <- s.ListenAndServeOn(l) }(l)
+	}
 
-	log.Fatal(s.ListenAndServe())
+	p := &process{
+		server:    s,
+		cl:        cl,
+		config:    config,
+		logFile:   logFile,
+		auditFile: auditFile,
+	}
+	defer func() {
+		p.logFile.Close()
+		p.auditFile.Close()
+	}()
+	p.handleSignals(errs)
 }
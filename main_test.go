@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfigKeepsDefaults(t *testing.T) {
+	config := settings{
+		Port:         "9999",
+		LogFile:      "tbit.log",
+		HistorySize:  20,
+		SlowConsumer: slowConsumerSettings{Policy: "block", Timeout: "1s"},
+	}
+	err := config.readConfig(strings.NewReader(`
+port = "1234"
+
+[SlowConsumer]
+Timeout = "250ms"
+
+[RoomSlowConsumer.lobby]
+Policy = "disconnect"
+MaxDrops = 5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != "1234" {
+		t.Errorf("expected Port to be read from the file, got %q", config.Port)
+	}
+	if config.LogFile != "tbit.log" || config.HistorySize != 20 {
+		t.Errorf("expected settings missing from the file to keep their defaults, got %+v", config)
+	}
+
+	server, rooms, err := config.slowConsumerPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SlowConsumerPolicy{Mode: BlockWithTimeout, Timeout: 250 * time.Millisecond}); server != want {
+		t.Errorf("server policy = %+v, want %+v", server, want)
+	}
+	if want := (SlowConsumerPolicy{Mode: Disconnect, Timeout: 250 * time.Millisecond, MaxDrops: 5}); rooms["lobby"] != want {
+		t.Errorf("lobby policy = %+v, want %+v", rooms["lobby"], want)
+	}
+}
+
+func TestSlowConsumerSettingsValidation(t *testing.T) {
+	for _, s := range []slowConsumerSettings{
+		{Policy: "sometimes"},
+		{Timeout: "soon"},
+		{Timeout: "-1s"},
+		{Policy: "disconnect"},
+	} {
+		if _, err := s.policy(SlowConsumerPolicy{}); err == nil {
+			t.Errorf("expected an error for %+v", s)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	config := defaultSettings()
+	err := config.readConfig(strings.NewReader(`
+DefaultRoom = "welcome"
+WelcomeText = """
+Hi {username}!
+"""
+AdminPassword = "hunter2"
+
+[[Room]]
+Name = "staff"
+Key = "s3cret"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := checkConfig(config, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hunter2", "s3cret"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("expected %s to be redacted, got:\n%s", secret, out.String())
+		}
+	}
+	if config.Room[0].Key != "s3cret" {
+		t.Error("expected redacting the output not to change the settings")
+	}
+	// The output is a config file with the effective values, so reading it back gives the same settings.
+	reread := defaultSettings()
+	reread.DefaultRoom = "lobby"
+	if err := reread.readConfig(strings.NewReader(out.String())); err != nil {
+		t.Fatal(err)
+	}
+	if reread.DefaultRoom != "welcome" || reread.WelcomeText != "Hi {username}!\n" || reread.OutputBufferSize != defaultOutputBufferSize {
+		t.Errorf("expected the effective settings in the output, got %+v", reread)
+	}
+
+	for _, file := range []string{`DefaultRoom = "two words"`, `OutputBufferSize = -1`, `ShutdownTimeout = "later"`} {
+		config := defaultSettings()
+		if err := config.readConfig(strings.NewReader(file)); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkConfig(config, ioutil.Discard); err == nil {
+			t.Errorf("expected an error for %s", file)
+		}
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	config, err := loadConfig("tbit.conf.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenerSettings(t *testing.T) {
+	config := defaultSettings()
+	err := config.readConfig(strings.NewReader(`
+[[Listener]]
+Addr = "127.0.0.1:9000"
+
+[[Listener]]
+Network = "unix"
+Addr = "/tmp/tbit.sock"
+Proto = "json"
+RequireLogin = true
+
+[Listener.PeerUsers]
+1000 = "deploy"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := config.listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Listener{
+		{Addr: "127.0.0.1:9000"},
+		{Network: "unix", Addr: "/tmp/tbit.sock", JSON: true, RequireLogin: true, PeerUsers: map[uint32]string{1000: "deploy"}},
+	}
+	if !reflect.DeepEqual(listeners, want) {
+		t.Fatalf("listeners = %+v, want %+v", listeners, want)
+	}
+
+	for _, ls := range []listenerSettings{
+		{Network: "udp", Addr: ":9000"},
+		{},
+		{Addr: ":9000", TLSCertFile: "cert.pem"},
+		{Addr: ":9000", Proto: "xml"},
+		{Addr: ":9000", PeerUsers: map[string]string{"1000": "deploy"}},
+		{Network: "unix", Addr: "tbit.sock", PeerUsers: map[string]string{"root": "deploy"}},
+		{Network: "unix", Addr: "tbit.sock", PeerUsers: map[string]string{"1000": "server"}},
+	} {
+		if _, err := ls.listener(); err == nil {
+			t.Errorf("expected an error for %+v", ls)
+		}
+	}
+}
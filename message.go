@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// MessageKind is what a Message is for, it decides how the message is rendered.
+type MessageKind int
+
+// The kinds of messages sent through rooms and to connections.
+const (
+	KindChat MessageKind = iota
+	KindJoin
+	KindLeave
+	KindNick
+	KindSystem
+	KindPrivate
+	// KindTopic tells a room its topic changed, or tells a connection joining a room its topic.
+	KindTopic
+	// KindBacklog carries a room's history, replayed to a connection joining the room, in Replay.
+	KindBacklog
+
+	// The kinds below are replies to commands. They are written straight to the connection that sent the command.
+	KindReply
+	KindError
+	KindList
+	KindItem
+	KindEnd
+
+	// KindPing asks the connection to answer with /pong and the token in Body, KindPong answers a /ping.
+	KindPing
+	KindPong
+)
+
+// kindNames are the names of the kinds used as the type of JSON protocol output.
+var kindNames = map[MessageKind]string{
+	KindChat:    "message",
+	KindJoin:    "join",
+	KindLeave:   "leave",
+	KindNick:    "nick",
+	KindSystem:  "system",
+	KindPrivate: "private",
+	KindTopic:   "topic",
+	KindBacklog: "backlog",
+	KindReply:   "reply",
+	KindError:   "error",
+	KindList:    "list",
+	KindItem:    "item",
+	KindEnd:     "end",
+	KindPing:    "ping",
+	KindPong:    "pong",
+}
+
+func (k MessageKind) String() string {
+	return kindNames[k]
+}
+
+// lastMessageID is the ID of the last stamped message, it is accessed atomically.
+var lastMessageID uint64
+
+// Message is a single piece of output for connections.
+// Messages are shared by all the connections they are sent to so they must not be changed once sent.
+// Each connection renders them for its own protocol when writing them.
+type Message struct {
+	ID     uint64
+	Time   time.Time
+	Room   string
+	Sender string
+	Kind   MessageKind
+	Body   string
+	// To is the recipient of a private message.
+	To string
+	// Nick is the new username of a nick message, Sender is the old one.
+	Nick string
+	// Echo is set on the copy of a private message sent back to its sender.
+	Echo bool
+	// Replay is the history of a backlog message, from oldest to newest.
+	Replay []*Message
+	// Info describes the room of an item listed by /rooms, it is only rendered for the JSON protocol.
+	Info *RoomSummary
+}
+
+// RoomSummary is what /rooms shows about a room.
+type RoomSummary struct {
+	Users     int    `json:"users"`
+	Topic     string `json:"topic"`
+	Permanent bool   `json:"permanent"`
+}
+
+// stamp gives the message a new ID and sets its time to now.
+func (m *Message) stamp() {
+	m.ID = atomic.AddUint64(&lastMessageID, 1)
+	m.Time = time.Now()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// roomModes change who can do what in a room. They are set by operators with /mode.
+type roomModes struct {
+	// topicLocked only lets operators change the topic and description, it is the topic mode.
+	topicLocked bool
+	// private hides the room from everyone who isn't in it.
+	private bool
+	// inviteOnly only lets connections that were invited with /invite join.
+	inviteOnly bool
+	// key has to be given to /join the room if it isn't empty.
+	key string
+}
+
+// defaultRoomModes are the modes of a new room.
+var defaultRoomModes = roomModes{topicLocked: true}
+
+// String lists the modes that are set, such as "+topic".
+func (m roomModes) String() string {
+	var list []string
+	if m.topicLocked {
+		list = append(list, "+topic")
+	}
+	if m.private {
+		list = append(list, "+private")
+	}
+	if m.inviteOnly {
+		list = append(list, "+invite")
+	}
+	// The key itself is never shown.
+	if m.key != "" {
+		list = append(list, "+key")
+	}
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, " ")
+}
+
+// set turns the named mode on or off, key is the key for turning the key mode on.
+func (m *roomModes) set(mode string, on bool, key string) error {
+	if mode != "key" && key != "" {
+		return fmt.Errorf("The %s mode doesn't take a key", mode)
+	}
+	switch mode {
+	case "topic":
+		m.topicLocked = on
+	case "private":
+		m.private = on
+	case "invite":
+		m.inviteOnly = on
+	case "key":
+		if on && key == "" {
+			return errors.New("The key mode needs a key, use /mode <room> +key <key>")
+		}
+		m.key = ""
+		if on {
+			m.key = key
+		}
+	default:
+		return fmt.Errorf("Unknown mode %s, the modes are topic, private, invite and key", mode)
+	}
+	return nil
+}
+
+// modes returns the modes of the room.
+func (r *Room) modes() roomModes {
+	r.RLock()
+	defer r.RUnlock()
+	return r.roomModes
+}
+
+// setModes replaces the modes of the room.
+func (r *Room) setModes(m roomModes) {
+	r.Lock()
+	defer r.Unlock()
+	r.roomModes = m
+}
+
+// invite lets the connection id join the room once, even if it is invite only or has a key.
+func (r *Room) invite(id int) {
+	r.Lock()
+	defer r.Unlock()
+	r.invites[id] = true
+}
+
+// checkAccess returns why the connection id can't join the room, key is what it gave for rooms with a key.
+// An invite lets it in whatever the modes are, invited is set so it can be used up once the join succeeds.
+func (r *Room) checkAccess(id int, key string) (invited bool, err error) {
+	r.RLock()
+	defer r.RUnlock()
+	if r.invites[id] {
+		return true, nil
+	}
+	if r.inviteOnly {
+		return false, errors.New("That room is invite only, ask an operator to /invite you")
+	}
+	if r.key != "" && key == "" {
+		return false, errors.New("That room needs a key, use /join <room> <key>")
+	}
+	if r.key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(r.key)) != 1 {
+		return false, errors.New("That is not the key of that room")
+	}
+	return false, nil
+}
+
+// useInvite removes the invite of the connection id once it has joined the room.
+func (r *Room) useInvite(id int) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.invites, id)
+}
+
+// canSee returns false if the room is private and the connection isn't in it. Admins can see every room.
+func (c *Conn) canSee(r *Room) bool {
+	return !r.modes().private || r.has(c.id) || c.isAdmin()
+}
+
+// visibleRoom returns the named room, or nil if it doesn't exist or the connection can't see it.
+func (c *Conn) visibleRoom(roomName string) *Room {
+	r := c.server.rooms.get(roomName)
+	if r == nil || !c.canSee(r) {
+		return nil
+	}
+	return r
+}
+
+// visibleRooms returns the names of the rooms the connection can see out of names.
+func (c *Conn) visibleRooms(names []string) []string {
+	list := []string{}
+	for _, name := range names {
+		if c.visibleRoom(name) != nil {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// Mode shows the modes of a room, or changes one of them with a change such as +topic or -topic.
+// The key mode is set with +key and the key as the argument.
+func (c *Conn) Mode(roomName, change, arg string) error {
+	if change == "" {
+		r := c.visibleRoom(roomName)
+		if r == nil {
+			return errors.New("That room does not exist")
+		}
+		c.replyf("Modes of %s: %s", roomName, r.modes())
+		return nil
+	}
+	r, override, err := c.opRoom(roomName)
+	if err != nil {
+		return err
+	}
+	if len(change) < 2 || (change[0] != '+' && change[0] != '-') {
+		return errors.New("Modes are changed with +<mode> or -<mode>, such as +topic")
+	}
+	m := r.modes()
+	err = m.set(change[1:], change[0] == '+', arg)
+	if err != nil {
+		return err
+	}
+	if override {
+		// The key itself isn't logged.
+		c.auditf("set mode %s in %s", change, roomName)
+	}
+	r.setModes(m)
+	r.broadcast(&Message{Kind: KindSystem, Body: fmt.Sprintf("%s set mode %s", c.name(), change)})
+	return nil
+}
+
+// Invite lets a user join a room once, even if it is invite only or has a key.
+func (c *Conn) Invite(roomName, username string) error {
+	r, override, err := c.opRoom(roomName)
+	if err != nil {
+		return err
+	}
+	target := c.server.lookupConn(username)
+	if target == nil {
+		return fmt.Errorf("There is no user named %s", username)
+	}
+	if override {
+		c.auditf("invited %s to %s", username, roomName)
+	}
+	r.invite(target.id)
+	m := &Message{Kind: KindSystem, Body: fmt.Sprintf("%s invited you to %s, use /join %s", c.name(), roomName, roomName)}
+	m.stamp()
+	target.send(m)
+	c.replyf("Invited %s to %s", username, roomName)
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoomModes(t *testing.T) {
+	s := NewServer()
+	alice := testConn(t, s, 1, "alice", "192.0.2.1:1000")
+	bob := testConn(t, s, 2, "bob", "192.0.2.2:1000")
+	if err := alice.JoinRoom("den", ""); err != nil {
+		t.Fatal(err)
+	}
+	s.rooms.create("lobby", roomOptions{})
+
+	if err := alice.Mode("den", "+private", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bob.visibleRooms(s.rooms.listAll()), []string{"lobby"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected a private room to be hidden from non-members, got %v", got)
+	}
+	if got, want := alice.visibleRooms(s.rooms.listAll()), []string{"den", "lobby"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected members to see a private room, got %v", got)
+	}
+	if err := bob.RoomInfo("den"); err == nil {
+		t.Error("expected a private room not to be described to non-members")
+	}
+
+	if err := alice.Mode("den", "+invite", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.JoinRoom("den", ""); err == nil {
+		t.Fatal("expected an invite only room to refuse someone who wasn't invited")
+	}
+	if err := alice.Invite("den", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.JoinRoom("den", ""); err != nil {
+		t.Fatalf("expected an invited user to join, got %s", err)
+	}
+	if err := bob.LeaveRoom("den"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.JoinRoom("den", ""); err == nil {
+		t.Fatal("expected an invite to only be used once")
+	}
+
+	if err := alice.Mode("den", "-invite", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Mode("den", "+key", ""); err == nil {
+		t.Error("expected the key mode to need a key")
+	}
+	if err := alice.Mode("den", "+key", "sesame"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.rooms.get("den").modes().String(); got != "+topic +private +key" {
+		t.Errorf("expected the modes to be listed without the key, got %q", got)
+	}
+	if err := bob.JoinRoom("den", ""); err == nil {
+		t.Error("expected a room with a key to refuse a join without it")
+	}
+	if err := bob.JoinRoom("den", "wrong"); err == nil {
+		t.Error("expected a room with a key to refuse the wrong key")
+	}
+	if err := bob.JoinRoom("den", "sesame"); err != nil {
+		t.Errorf("expected the key to let bob in, got %s", err)
+	}
+	if err := bob.Mode("den", "-key", ""); err == nil {
+		t.Error("expected only operators to change the modes")
+	}
+}
+
+func TestInviteKeptWhenRefused(t *testing.T) {
+	s := NewServer()
+	alice := testConn(t, s, 1, "alice", "192.0.2.1:1000")
+	bob := testConn(t, s, 2, "bob", "198.51.100.7:1000")
+	if err := alice.JoinRoom("den", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Mode("den", "+private", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Mode("den", "+invite", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Operator commands don't reveal a private room to someone who can't see it.
+	if err := bob.Kick("den", "alice", ""); err == nil || err.Error() != "That room does not exist" {
+		t.Errorf("expected a hidden room not to exist for operator commands, got %v", err)
+	}
+
+	if err := alice.Ban("den", "bob", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Invite("den", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.JoinRoom("den", ""); err == nil {
+		t.Fatal("expected an invite not to get around a ban")
+	}
+	if err := alice.Unban("den", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.JoinRoom("den", ""); err != nil {
+		t.Errorf("expected the invite to be kept when the join was refused, got %s", err)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// ban stops connections matching its mask from joining a room until it expires.
+// Mutes are bans in a separate list of the room that stop matching connections from talking instead.
+type ban struct {
+	// mask is an IP address, a network such as 10.0.0.0/8, or a username pattern such as troll*.
+	mask string
+	by   string
+	// expires is when the ban ends, it never does if it is zero.
+	expires time.Time
+}
+
+// expired returns true if the ban has ended.
+func (b ban) expired(now time.Time) bool {
+	return !b.expires.IsZero() && now.After(b.expires)
+}
+
+// matches returns true if the mask matches the IP address of the connection or its username.
+func (b ban) matches(c *Conn, username string) bool {
+	if strings.Contains(b.mask, "/") {
+		_, network, err := net.ParseCIDR(b.mask)
+		ip := connIP(c)
+		return err == nil && ip != nil && network.Contains(ip)
+	}
+	if ip := net.ParseIP(b.mask); ip != nil {
+		return ip.Equal(connIP(c))
+	}
+	ok, _ := path.Match(b.mask, username)
+	return ok
+}
+
+// String describes the ban for listing.
+func (b ban) String() string {
+	if b.expires.IsZero() {
+		return fmt.Sprintf("%s by %s", b.mask, b.by)
+	}
+	return fmt.Sprintf("%s by %s until %s", b.mask, b.by, b.expires.Format(time.RFC3339))
+}
+
+// validBanMask returns an error if the mask can't be used for a ban.
+func validBanMask(mask string) error {
+	if strings.Contains(mask, "/") {
+		_, _, err := net.ParseCIDR(mask)
+		return err
+	}
+	_, err := path.Match(mask, "")
+	return err
+}
+
+// literalMask returns a mask that only matches the username, escaping the characters path.Match treats as patterns.
+func literalMask(username string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(username)
+}
+
+// connIP returns the IP address of the connection, or nil if it doesn't have one such as for unix sockets.
+func connIP(c *Conn) net.IP {
+	host, _, err := net.SplitHostPort(c.remoteAddr)
+	if err != nil {
+		host = c.remoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// parseOptionalDuration parses the duration argument of /ban and /mute, 0 means forever.
+func parseOptionalDuration(fields []string, i int) (time.Duration, error) {
+	if len(fields) <= i {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(fields[i])
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid duration %s, use something like 10m or 2h", fields[i])
+	}
+	return d, nil
+}
+
+// until returns when something lasting d from now ends, or the zero time if d is 0 and it lasts forever.
+func until(d time.Duration) time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// forDuration describes how long something lasts for the messages about bans and mutes.
+func forDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return " for " + d.String()
+}
+
+// isOp returns true if the connection id is an operator of the room.
+func (r *Room) isOp(id int) bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.ops[id]
+}
+
+// setOp makes the connection id an operator of the room, or stops it being one.
+func (r *Room) setOp(id int, op bool) {
+	r.Lock()
+	defer r.Unlock()
+	if op {
+		r.ops[id] = true
+	} else {
+		delete(r.ops, id)
+	}
+}
+
+// matchesAny returns true if the connection matches one of the bans that hasn't expired.
+func matchesAny(bans []ban, c *Conn) bool {
+	if len(bans) == 0 {
+		return false
+	}
+	now := time.Now()
+	username := c.server.usernames.getUsername(c.id)
+	for _, b := range bans {
+		if !b.expired(now) && b.matches(c, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// withBan returns bans with b added, replacing any ban with the same mask, and without the expired bans.
+func withBan(bans []ban, b ban) []ban {
+	now := time.Now()
+	list := bans[:0]
+	for _, old := range bans {
+		if old.mask != b.mask && !old.expired(now) {
+			list = append(list, old)
+		}
+	}
+	return append(list, b)
+}
+
+// activeBans describes the bans that haven't expired.
+func activeBans(bans []ban) []string {
+	now := time.Now()
+	list := []string{}
+	for _, b := range bans {
+		if !b.expired(now) {
+			list = append(list, b.String())
+		}
+	}
+	return list
+}
+
+// bannedLocked returns true if the connection matches a ban that hasn't expired, r must be locked.
+func (r *Room) bannedLocked(c *Conn) bool {
+	return matchesAny(r.bans, c)
+}
+
+// addBan adds a ban to the room, replacing any ban with the same mask, and removes the expired bans.
+func (r *Room) addBan(b ban) {
+	r.Lock()
+	defer r.Unlock()
+	r.bans = withBan(r.bans, b)
+}
+
+// removeBan removes the ban with the mask, it returns false if there wasn't one.
+func (r *Room) removeBan(mask string) bool {
+	r.Lock()
+	defer r.Unlock()
+	for i, b := range r.bans {
+		if b.mask == mask {
+			r.bans = append(r.bans[:i], r.bans[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// listBans returns the bans of the room that haven't expired.
+func (r *Room) listBans() []string {
+	r.RLock()
+	defer r.RUnlock()
+	return activeBans(r.bans)
+}
+
+// members returns the connections in the room, the list must not be changed.
+func (r *Room) members() []*Conn {
+	r.RLock()
+	defer r.RUnlock()
+	return r.recipients
+}
+
+// mute stops connections matching the mask of the ban from talking in the room until it expires.
+func (r *Room) mute(b ban) {
+	r.Lock()
+	defer r.Unlock()
+	r.mutes = withBan(r.mutes, b)
+}
+
+// unmute removes the mutes of the room that remove returns true for, it returns false if there weren't any.
+func (r *Room) unmute(remove func(ban) bool) bool {
+	r.Lock()
+	defer r.Unlock()
+	mutes := r.mutes[:0]
+	for _, b := range r.mutes {
+		if !remove(b) {
+			mutes = append(mutes, b)
+		}
+	}
+	removed := len(mutes) < len(r.mutes)
+	r.mutes = mutes
+	return removed
+}
+
+// listMutes returns the mutes of the room that haven't expired.
+func (r *Room) listMutes() []string {
+	r.RLock()
+	defer r.RUnlock()
+	return activeBans(r.mutes)
+}
+
+// forget removes the invites of a connection id that has disconnected from all the rooms.
+// Mutes are kept since they match the username or a mask, so reconnecting doesn't end them.
+func (rl *roomList) forget(id int) {
+	for _, name := range rl.listAll() {
+		if r := rl.get(name); r != nil {
+			r.Lock()
+			delete(r.invites, id)
+			r.Unlock()
+		}
+	}
+}
+
+// muted returns true if the connection can't talk in the room.
+func (r *Room) muted(c *Conn) bool {
+	r.RLock()
+	defer r.RUnlock()
+	return matchesAny(r.mutes, c)
+}
+
+// opRoom returns the named room if the connection is one of its operators. Admins operate every room,
+// override is set when the connection only operates it as an admin so the action can be audited.
+// Private rooms the connection can't see don't exist as far as it is told.
+func (c *Conn) opRoom(roomName string) (r *Room, override bool, err error) {
+	r = c.visibleRoom(roomName)
+	if r == nil {
+		return nil, false, errors.New("That room does not exist")
+	}
+	if r.isOp(c.id) {
+		return r, false, nil
+	}
+	if !c.isAdmin() {
+		return nil, false, errors.New("You are not an operator of that room")
+	}
+	return r, true, nil
+}
+
+// member returns the connection using the username if it is in the room.
+func (c *Conn) member(r *Room, username string) (*Conn, error) {
+	target := c.server.lookupConn(username)
+	if target == nil || !r.has(target.id) {
+		return nil, fmt.Errorf("%s is not in %s", username, r.Name)
+	}
+	return target, nil
+}
+
+// Op makes a user in a room an operator of it, or stops them being one, and tells the room.
+func (c *Conn) Op(roomName, username string, op bool) error {
+	r, override, err := c.opRoom(roomName)
+	if err != nil {
+		return err
+	}
+	target, err := c.member(r, username)
+	if err != nil {
+		return err
+	}
+	if override {
+		c.auditf("set operator %s to %t in %s", username, op, roomName)
+	}
+	r.setOp(target.id, op)
+	body := fmt.Sprintf("%s made %s an operator", c.name(), username)
+	if !op {
+		body = fmt.Sprintf("%s removed %s as an operator", c.name(), username)
+	}
+	r.broadcast(&Message{Kind: KindSystem, Body: body})
+	return nil
+}
+
+// Kick removes a user from a room, telling the room who kicked them and why.
+func (c *Conn) Kick(roomName, username, reason string) error {
+	r, override, err := c.opRoom(roomName)
+	if err != nil {
+		return err
+	}
+	target, err := c.member(r, username)
+	if err != nil {
+		return err
+	}
+	if override {
+		c.auditf("kicked %s from %s (%s)", username, roomName, reason)
+	}
+	body := fmt.Sprintf("%s was kicked by %s", username, c.name())
+	if reason != "" {
+		body = fmt.Sprintf("%s (%s)", body, reason)
+	}
+	return target.removeFromRoom(roomName, &Message{Kind: KindLeave, Sender: username, Body: body})
+}
+
+// Ban stops connections matching the mask from joining a room for d, or until they are unbanned if d is 0.
+// Anyone in the room matching the mask is removed from it.
+func (c *Conn) Ban(roomName, mask string, d time.Duration) error {
+	r, override, err := c.opRoom(roomName)
+	if err != nil {
+		return err
+	}
+	if err := validBanMask(mask); err != nil {
+		return fmt.Errorf("Invalid mask %s: %s", mask, err)
+	}
+	if override {
+		c.auditf("banned %s from %s%s", mask, roomName, forDuration(d))
+	}
+	b := ban{mask: mask, by: c.name(), expires: until(d)}
+	r.addBan(b)
+	r.broadcast(&Message{Kind: KindSystem, Body: fmt.Sprintf("%s banned %s%s", c.name(), mask, forDuration(d))})
+	for _, member := range r.members() {
+		username := c.server.usernames.getUsername(member.id)
+		if member == c || !b.matches(member, username) {
+			continue
+		}
+		body := fmt.Sprintf("%s was banned by %s", username, c.name())
+		member.removeFromRoom(roomName, &Message{Kind: KindLeave, Sender: username, Body: body})
+	}
+	return nil
+}
+
+// Unban removes the ban with the mask from a room.
+func (c *Conn) Unban(roomName, mask string) error {
+	r, override, err := c.opRoom(roomName)
+	if err != nil {
+		return err
+	}
+	if !r.removeBan(mask) {
+		return fmt.Errorf("%s is not banned from %s", mask, roomName)
+	}
+	if override {
+		c.auditf("unbanned %s from %s", mask, roomName)
+	}
+	r.broadcast(&Message{Kind: KindSystem, Body: fmt.Sprintf("%s unbanned %s", c.name(), mask)})
+	return nil
+}
+
+// Mute stops a user in a room, or connections matching a mask, from talking in it for d, or until they are
+// unmuted if d is 0. A user is muted by their username so reconnecting doesn't end it, their IP address is
+// only muted if it is given as the mask since others can share it.
+func (c *Conn) Mute(roomName, target string, d time.Duration) error {
+	r, override, err := c.opRoom(roomName)
+	if err != nil {
+		return err
+	}
+	mask := target
+	member, err := c.member(r, target)
+	if err == nil {
+		mask = literalMask(target)
+	} else if maskErr := validBanMask(target); maskErr != nil {
+		return fmt.Errorf("%s, and it is not a valid mask: %s", err, maskErr)
+	}
+	if override {
+		c.auditf("muted %s in %s%s", target, roomName, forDuration(d))
+	}
+	r.mute(ban{mask: mask, by: c.name(), expires: until(d)})
+	if member != nil {
+		m := &Message{Kind: KindSystem, Room: roomName, Body: fmt.Sprintf("You have been muted by %s%s", c.name(), forDuration(d))}
+		m.stamp()
+		member.send(m)
+	}
+	c.replyf("%s is muted in %s%s", target, roomName, forDuration(d))
+	return nil
+}
+
+// Unmute removes the mute Mute added for a user, or the mute with a mask. Other mutes matching the user,
+// such as their address or a username pattern, are left for the operator to remove.
+func (c *Conn) Unmute(roomName, target string) error {
+	r, override, err := c.opRoom(roomName)
+	if err != nil {
+		return err
+	}
+	removed := r.unmute(func(b ban) bool {
+		return b.mask == target || b.mask == literalMask(target)
+	})
+	if !removed {
+		return fmt.Errorf("%s is not muted in %s", target, roomName)
+	}
+	if override {
+		c.auditf("unmuted %s in %s", target, roomName)
+	}
+	if member := c.server.lookupConn(target); member != nil && r.has(member.id) {
+		m := &Message{Kind: KindSystem, Room: roomName, Body: fmt.Sprintf("You have been unmuted by %s", c.name())}
+		m.stamp()
+		member.send(m)
+	}
+	c.replyf("%s is no longer muted in %s", target, roomName)
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConn adds a connection that discards its output to the server.
+func testConn(t *testing.T, s *Server, id int, username, remoteAddr string) *Conn {
+	c := &Conn{
+		id:         id,
+		c:          discardConn{},
+		server:     s,
+		username:   username,
+		remoteAddr: remoteAddr,
+		outputChan: make(chan *Message, 100),
+		rooms:      make(map[string]bool),
+	}
+	if err := s.usernames.addUsername(c.id, c.username); err != nil {
+		t.Fatal(err)
+	}
+	s.conns.add(c)
+	return c
+}
+
+func TestRoomOperators(t *testing.T) {
+	s := NewServer()
+	alice := testConn(t, s, 1, "alice", "192.0.2.1:1000")
+	bob := testConn(t, s, 2, "bob", "198.51.100.7:1000")
+	if err := alice.JoinRoom("den", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.JoinRoom("den", ""); err != nil {
+		t.Fatal(err)
+	}
+	den := s.rooms.get("den")
+	if got, want := den.listUsernames(s.usernames), []string{"@alice", "bob"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the first joiner to operate the room, got %v", got)
+	}
+	if err := bob.Kick("den", "alice", ""); err == nil {
+		t.Fatal("expected someone who isn't an operator to be refused")
+	}
+
+	if err := alice.Mute("den", "bob", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Say("den", "hello"); err == nil {
+		t.Error("expected a muted user not to be able to talk")
+	}
+	if err := bob.Announce("hello"); err == nil {
+		t.Error("expected a muted user not to be able to talk")
+	}
+	if err := alice.Unmute("den", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Say("den", "hello"); err != nil {
+		t.Errorf("expected an unmuted user to be able to talk, got %s", err)
+	}
+
+	if err := alice.Kick("den", "bob", "spamming"); err != nil {
+		t.Fatal(err)
+	}
+	if bob.inRoom("den") || den.has(bob.id) {
+		t.Fatal("expected bob to be removed from the room")
+	}
+
+	if err := alice.Ban("den", "bo*", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.JoinRoom("den", ""); err == nil {
+		t.Fatal("expected a banned username not to be able to join")
+	}
+	if err := alice.Unban("den", "bo*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.JoinRoom("den", ""); err != nil {
+		t.Fatalf("expected bob to join once unbanned, got %s", err)
+	}
+
+	// Banning a network removes anyone in the room from it.
+	if err := alice.Ban("den", "198.51.100.0/24", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if bob.inRoom("den") {
+		t.Fatal("expected bob to be removed from the room when bob's network was banned")
+	}
+	if err := bob.JoinRoom("den", ""); err == nil {
+		t.Fatal("expected a banned address not to be able to join")
+	}
+	if err := alice.Ban("den", "[", 0); err == nil {
+		t.Error("expected an invalid mask to be refused")
+	}
+}
+
+func TestBanExpires(t *testing.T) {
+	s := NewServer()
+	bob := testConn(t, s, 2, "bob", "198.51.100.7:1000")
+	den, _ := s.rooms.create("den", roomOptions{})
+	den.addBan(ban{mask: "198.51.100.7", expires: time.Now().Add(-time.Second)})
+	if err := bob.JoinRoom("den", ""); err != nil {
+		t.Fatalf("expected an expired ban to be ignored, got %s", err)
+	}
+	if got := den.listBans(); len(got) != 0 {
+		t.Errorf("expected expired bans not to be listed, got %v", got)
+	}
+}
+
+func TestMuteSurvivesReconnect(t *testing.T) {
+	s := NewServer()
+	alice := testConn(t, s, 1, "alice", "192.0.2.1:1000")
+	bob := testConn(t, s, 2, "bob", "198.51.100.7:1000")
+	for _, c := range []*Conn{alice, bob} {
+		if err := c.JoinRoom("den", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alice.Mute("den", "bob", 0); err != nil {
+		t.Fatal(err)
+	}
+	bob.closeChan = make(chan struct{}, 1)
+	bob.Close()
+
+	bob = testConn(t, s, 3, "bob", "203.0.113.9:1000")
+	guest := testConn(t, s, 4, "Anonymous4", "198.51.100.7:2000")
+	for _, c := range []*Conn{bob, guest} {
+		if err := c.JoinRoom("den", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bob.Say("den", "hello"); err == nil {
+		t.Error("expected reconnecting not to end a mute")
+	}
+	if err := guest.Say("den", "hello"); err != nil {
+		t.Errorf("expected muting a user not to mute others behind the same address, got %s", err)
+	}
+
+	// An operator has to ask for an address to be muted.
+	if err := alice.Mute("den", "198.51.100.7", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := guest.Say("den", "hello"); err == nil {
+		t.Error("expected a muted address not to be able to talk")
+	}
+	if err := alice.Unmute("den", "Anonymous4"); err == nil {
+		t.Error("expected unmuting a user not to remove a mute of their address")
+	}
+	if err := alice.Unmute("den", "198.51.100.7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := guest.Say("den", "hello"); err != nil {
+		t.Errorf("expected unmuting the address to let it talk, got %s", err)
+	}
+
+	// Unmuting a user only removes the mute added for them, not patterns that also match them.
+	if err := alice.Mute("den", "b?b*", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Unmute("den", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Say("den", "hello"); err == nil {
+		t.Error("expected a pattern mute to be kept when a user matching it is unmuted")
+	}
+
+	// Usernames are muted literally, not as patterns.
+	star := testConn(t, s, 5, "b*", "192.0.2.5:1000")
+	carol := testConn(t, s, 6, "carol", "192.0.2.6:1000")
+	for _, c := range []*Conn{star, carol} {
+		if err := c.JoinRoom("den", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alice.Mute("den", "b*", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := star.Say("den", "hello"); err == nil {
+		t.Error("expected the muted user to not be able to talk")
+	}
+	if err := alice.Mute("den", "c*", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := carol.Say("den", "hello"); err == nil {
+		t.Error("expected a username pattern to mute the users matching it")
+	}
+	want := []string{"b?b* by alice", "c* by alice"}
+	if got := s.rooms.get("den").listMutes(); len(got) != 3 || got[0] != want[0] || !strings.HasPrefix(got[1], `b\* by alice until `) || got[2] != want[1] {
+		t.Errorf("expected the mutes to be listed, got %v", got)
+	}
+	if err := alice.Mute("den", "[", 0); err == nil {
+		t.Error("expected an invalid mask to be refused")
+	}
+}
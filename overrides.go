@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envPrefix starts the environment variables that override settings. The rest of the variable is the
+// name of the setting in upper case, such as TBIT_PORT or TBIT_LOGFILE. TBIT_CONFIG is the config file to read.
+const envPrefix = "TBIT_"
+
+// defaultConfigFile is read when neither -config nor TBIT_CONFIG is set.
+const defaultConfigFile = "tbit.conf"
+
+// commandLine holds the command line flags. Flags that override settings are empty when they weren't given.
+type commandLine struct {
+	config      string
+	addr        string
+	logFile     string
+	checkConfig bool
+	// lookupEnv reads environment variables, it is os.LookupEnv except in tests.
+	lookupEnv func(string) (string, bool)
+}
+
+// parseFlags parses the command line arguments, not including the program name.
+func parseFlags(args []string, lookupEnv func(string) (string, bool)) (*commandLine, error) {
+	cl := &commandLine{lookupEnv: lookupEnv}
+	fs := flag.NewFlagSet("tbit", flag.ContinueOnError)
+	fs.StringVar(&cl.config, "config", "", "the config file to read, defaults to $TBIT_CONFIG or "+defaultConfigFile)
+	fs.StringVar(&cl.addr, "addr", "", "the host:port to listen on, overrides Host and Port")
+	fs.StringVar(&cl.logFile, "log", "", "the file to log to, overrides LogFile")
+	fs.BoolVar(&cl.checkConfig, "check-config", false, "check the config file and print the effective settings, then exit")
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+	return cl, nil
+}
+
+// loadSettings returns the settings from, in increasing order of precedence, the defaults, the config file,
+// the environment and the command line. A missing config file is only an error if it was named with
+// -config or TBIT_CONFIG.
+func (cl *commandLine) loadSettings() (settings, error) {
+	path, named := cl.config, true
+	if path == "" {
+		path, named = cl.lookupEnv(envPrefix + "CONFIG")
+	}
+	if path == "" {
+		path, named = defaultConfigFile, false
+	}
+	config, err := loadConfig(path)
+	if os.IsNotExist(err) && !named {
+		log.Print("config file not found, using defaults")
+	} else if err != nil {
+		return config, err
+	}
+	err = config.applyEnv(cl.lookupEnv)
+	if err != nil {
+		return config, err
+	}
+	err = cl.apply(&config)
+	return config, err
+}
+
+// apply sets the settings given on the command line.
+func (cl *commandLine) apply(s *settings) error {
+	if cl.addr != "" {
+		host, port, err := net.SplitHostPort(cl.addr)
+		if err != nil {
+			return fmt.Errorf("invalid -addr: %s", err)
+		}
+		s.Host, s.Port = host, port
+	}
+	if cl.logFile != "" {
+		s.LogFile = cl.logFile
+	}
+	return nil
+}
+
+// applyEnv sets each setting that has an environment variable. Only string, integer and boolean settings
+// can be set this way, tables such as SlowConsumer have to be set in the config file.
+func (s *settings) applyEnv(lookupEnv func(string) (string, bool)) error {
+	v := reflect.ValueOf(s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := envPrefix + strings.ToUpper(v.Type().Field(i).Name)
+		value, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", name, err)
+			}
+			f.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", name, err)
+			}
+			f.SetBool(b)
+		default:
+			return fmt.Errorf("%s can't be set from the environment, set it in the config file", name)
+		}
+	}
+	return nil
+}
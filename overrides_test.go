@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// noEnv is a lookupEnv with no environment variables set.
+func noEnv(string) (string, bool) {
+	return "", false
+}
+
+// env returns a lookupEnv that only has the variables in vars.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestSettingsPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tbit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tbit.conf")
+	err = ioutil.WriteFile(path, []byte(`
+Port = "1000"
+LogFile = "file.log"
+HistorySize = 5
+DefaultRoom = "file"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars := map[string]string{
+		"TBIT_CONFIG":       path,
+		"TBIT_PORT":         "2000",
+		"TBIT_LOGFILE":      "env.log",
+		"TBIT_DEFAULTROOM":  "env",
+		"TBIT_REQUIRELOGIN": "true",
+	}
+	cl, err := parseFlags([]string{"-log", "flag.log"}, env(vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := cl.loadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AccountsFile != "tbit.accounts" {
+		t.Errorf("expected the default AccountsFile, got %q", config.AccountsFile)
+	}
+	if config.HistorySize != 5 {
+		t.Errorf("expected HistorySize from the config file, got %d", config.HistorySize)
+	}
+	if config.Port != "2000" || config.DefaultRoom != "env" || !config.RequireLogin {
+		t.Errorf("expected the environment to override the config file, got %+v", config)
+	}
+	if config.LogFile != "flag.log" {
+		t.Errorf("expected -log to override the environment, got %q", config.LogFile)
+	}
+
+	cl, err = parseFlags([]string{"-config", path, "-addr", "127.0.0.1:3000"}, env(vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = cl.loadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "127.0.0.1" || config.Port != "3000" || config.LogFile != "env.log" {
+		t.Errorf("expected -addr to override the environment, got %+v", config)
+	}
+}
+
+func TestSettingsOverrideErrors(t *testing.T) {
+	for _, vars := range []map[string]string{
+		{"TBIT_HISTORYSIZE": "lots"},
+		{"TBIT_REQUIRELOGIN": "maybe"},
+		{"TBIT_SLOWCONSUMER": "drop-newest"},
+		{"TBIT_CONFIG": "does-not-exist.conf"},
+	} {
+		cl, err := parseFlags(nil, env(vars))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cl.loadSettings(); err == nil {
+			t.Errorf("expected an error for %v", vars)
+		}
+	}
+
+	for _, args := range [][]string{{"-addr", "9999"}, {"-config", "does-not-exist.conf"}} {
+		cl, err := parseFlags(args, noEnv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cl.loadSettings(); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// PermanentRoom is a room that exists from when the server starts and is never removed for being empty.
+type PermanentRoom struct {
+	Name        string
+	Topic       string
+	Description string
+	modes       roomModes
+}
+
+// defaultEmptyRoomTimeout is how long a room that isn't permanent can be empty before it is removed
+// when EmptyRoomTimeout isn't set.
+const defaultEmptyRoomTimeout = 10 * time.Minute
+
+// roomGCInterval is how often the rooms are checked for having been empty for EmptyRoomTimeout.
+const roomGCInterval = 10 * time.Second
+
+// errRoomRemoved is returned by Room.Join for a room that was removed while it was being joined.
+var errRoomRemoved = errors.New("That room was removed")
+
+// ensureRooms creates the permanent rooms that don't exist yet and marks which rooms are permanent,
+// which are the PermanentRooms and the DefaultRoom. A room gets the topic, description and modes of its
+// definition when it becomes permanent, after that they can be changed like those of any other room.
+// When a reload changes the definition of a permanent room the parts that changed are applied again.
+func (s *Server) ensureRooms() {
+	opts := s.options()
+	definitions := map[string]PermanentRoom{opts.DefaultRoom: {Name: opts.DefaultRoom, modes: defaultRoomModes}}
+	for _, p := range opts.PermanentRooms {
+		definitions[p.Name] = p
+		s.rooms.create(p.Name, s.roomOptions(p.Name))
+	}
+	s.rooms.create(opts.DefaultRoom, s.roomOptions(opts.DefaultRoom))
+	for _, name := range s.rooms.listAll() {
+		r := s.rooms.get(name)
+		if r == nil {
+			continue
+		}
+		p, ok := definitions[name]
+		r.Lock()
+		first := ok && !r.permanent
+		old := r.definition
+		// A room's first topic is set quietly, only a topic changed by a reload is announced.
+		announceTopic := ok && !first && p.Topic != "" && p.Topic != old.Topic
+		if ok {
+			if first && p.Topic != "" {
+				r.topic = p.Topic
+				r.topicBy = "server"
+				r.topicSet = time.Now()
+			}
+			if p.Description != "" && (first || p.Description != old.Description) {
+				r.description = p.Description
+			}
+			if first || p.modes != old.modes {
+				r.roomModes = p.modes
+			}
+		}
+		r.permanent = ok
+		r.definition = p
+		r.Unlock()
+		if announceTopic {
+			// Outside the lock since it tells everyone in the room.
+			r.setTopic(p.Topic, "server")
+		}
+	}
+}
+
+// collectRooms removes the rooms that aren't permanent and have been empty for EmptyRoomTimeout.
+// Nobody is told, since nobody is in them.
+func (s *Server) collectRooms(now time.Time) {
+	timeout := s.options().EmptyRoomTimeout
+	if timeout <= 0 {
+		return
+	}
+	for _, name := range s.rooms.listAll() {
+		s.rooms.removeIf(name, func(r *Room) bool {
+			return !r.permanent && len(r.Conns) == 0 && now.Sub(r.emptySince) >= timeout
+		})
+	}
+}
+
+// collectRoomsEvery runs collectRooms every interval until the server shuts down.
+func (s *Server) collectRoomsEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if s.shuttingDown() {
+			return
+		}
+		s.collectRooms(now)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPermanentRooms(t *testing.T) {
+	config := defaultSettings()
+	err := config.readConfig(strings.NewReader(`
+EmptyRoomTimeout = "1m"
+
+[[Room]]
+Name = "news"
+Topic = "read only"
+Modes = ["topic", "private"]
+Key = "s3cret"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := config.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PermanentRoom{{Name: "news", Topic: "read only", modes: roomModes{topicLocked: true, private: true, key: "s3cret"}}}
+	if !reflect.DeepEqual(opts.PermanentRooms, want) || opts.EmptyRoomTimeout != time.Minute {
+		t.Fatalf("expected the rooms to be read, got %+v %s", opts.PermanentRooms, opts.EmptyRoomTimeout)
+	}
+
+	s := NewServer()
+	s.Options = opts
+	s.ensureRooms()
+	news := s.rooms.get("news")
+	if news == nil {
+		t.Fatal("expected the permanent room to be created")
+	}
+	if info := news.info(); !info.permanent || info.topic != "read only" || news.modes() != want[0].modes {
+		t.Errorf("expected the room to be set up from its definition, got %+v %+v", info, news.modes())
+	}
+	if got := news.history.last(); len(got) != 0 {
+		t.Errorf("expected the declared topic to be set without announcing it, got %+v", got[0])
+	}
+	if !s.rooms.get(opts.DefaultRoom).info().permanent {
+		t.Error("expected the default room to be permanent")
+	}
+
+	alice := testConn(t, s, 1, "alice", "192.0.2.1:1000")
+	if err := alice.JoinRoom("den", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.JoinRoom("attic", ""); err != nil {
+		t.Fatal(err)
+	}
+	attic := s.rooms.get("attic")
+	if err := alice.LeaveRoom("attic"); err != nil {
+		t.Fatal(err)
+	}
+	s.collectRooms(time.Now().Add(30 * time.Second))
+	if s.rooms.get("attic") == nil {
+		t.Fatal("expected an empty room to be kept until EmptyRoomTimeout has passed")
+	}
+	s.collectRooms(time.Now().Add(2 * time.Minute))
+	if got, want := s.rooms.listAll(), []string{"den", opts.DefaultRoom, "news"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected only the empty ad-hoc room to be removed, got %v", got)
+	}
+	if err := attic.Join(alice); err != errRoomRemoved {
+		t.Errorf("expected a removed room not to be joined, got %v", err)
+	}
+	if err := alice.JoinRoom("attic", ""); err != nil || s.rooms.get("attic") == nil {
+		t.Errorf("expected joining a removed room to create it again, got %v", err)
+	}
+
+	for _, rs := range []roomSettings{
+		{},
+		{Name: "two words"},
+		{Name: "news", Modes: []string{"loud"}},
+		{Name: "news", Modes: []string{"key"}},
+	} {
+		if _, err := rs.permanentRoom(); err == nil {
+			t.Errorf("expected an error for %+v", rs)
+		}
+	}
+	config.Room = append(config.Room, config.Room[0])
+	if _, err := config.options(); err == nil {
+		t.Error("expected a room declared twice to be rejected")
+	}
+}
+
+func TestPermanentRoomReload(t *testing.T) {
+	s := NewServer()
+	opts := s.options()
+	opts.HistorySize = 10
+	opts.PermanentRooms = []PermanentRoom{{Name: "news", Topic: "read only", modes: roomModes{topicLocked: true}}}
+	s.Reload(opts)
+	news := s.rooms.get("news")
+	if info := news.info(); info.topic != "read only" || len(news.history.last()) != 0 {
+		t.Fatalf("expected the first topic to be set quietly, got %q and %d messages", info.topic, len(news.history.last()))
+	}
+	alice := testConn(t, s, 1, "alice", "192.0.2.1:1000")
+	alice.admin = 1
+	if err := alice.Topic("news", "changed by hand"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reloading the same definition leaves the room alone.
+	s.Reload(opts)
+	if got := news.info().topic; got != "changed by hand" {
+		t.Errorf("expected an unchanged definition not to reset the topic, got %q", got)
+	}
+
+	opts.PermanentRooms = []PermanentRoom{{Name: "news", Topic: "read only", modes: roomModes{topicLocked: true, key: "s3cret"}}}
+	s.Reload(opts)
+	if news.modes().key != "s3cret" || news.info().topic != "changed by hand" {
+		t.Errorf("expected only the new key to be applied, got %+v %q", news.modes(), news.info().topic)
+	}
+
+	opts.PermanentRooms = []PermanentRoom{{Name: "news", Topic: "breaking", modes: roomModes{topicLocked: true, key: "s3cret"}}}
+	s.Reload(opts)
+	if info := news.info(); info.topic != "breaking" || info.topicBy != "server" {
+		t.Errorf("expected the new topic to be applied, got %q by %s", info.topic, info.topicBy)
+	}
+	if history := news.history.last(); len(history) == 0 || history[len(history)-1].Kind != KindTopic {
+		t.Error("expected a topic changed by a reload to be announced")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	// Embed the timezone database so /set tz works on systems without one installed.
+	_ "time/tzdata"
+)
+
+// timeFormats are the named timestamp formats of /set timefmt. Anything else is used as a custom layout.
+var timeFormats = map[string]string{
+	"rfc3339": time.RFC3339,
+	"short":   "15:04",
+	"none":    "",
+}
+
+// displayPrefs are a connection's preferences for how timestamps are shown.
+// They are replaced rather than modified so they can be shared with the goroutine writing the output.
+type displayPrefs struct {
+	// TimeZone and TimeFormat are what the user set, they are what is saved for registered accounts.
+	TimeZone   string
+	TimeFormat string
+
+	loc    *time.Location
+	layout string
+}
+
+// defaultDisplayPrefs shows timestamps as RFC 3339 in the server's timezone.
+var defaultDisplayPrefs = &displayPrefs{
+	TimeFormat: "rfc3339",
+	layout:     time.RFC3339,
+}
+
+// newDisplayPrefs validates a timezone and time format. Empty values use the defaults.
+func newDisplayPrefs(timeZone, timeFormat string) (*displayPrefs, error) {
+	d := *defaultDisplayPrefs
+	if timeZone != "" {
+		loc, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", timeZone)
+		}
+		d.TimeZone = timeZone
+		d.loc = loc
+	}
+	if timeFormat != "" {
+		layout, ok := timeFormats[timeFormat]
+		if !ok {
+			// A custom layout has to have at least one element of the reference time in it.
+			if time.Unix(0, 0).Format(timeFormat) == timeFormat {
+				return nil, fmt.Errorf("%q is not a time format, use rfc3339, short, none or a layout like \"Jan _2 15:04:05\"", timeFormat)
+			}
+			layout = timeFormat
+		}
+		d.TimeFormat = timeFormat
+		d.layout = layout
+	}
+	return &d, nil
+}
+
+// location returns the timezone to show times in.
+func (d *displayPrefs) location() *time.Location {
+	if d.loc == nil {
+		return time.Local
+	}
+	return d.loc
+}
+
+// timestamp formats a time followed by a space, or returns nothing if timestamps are turned off.
+func (d *displayPrefs) timestamp(t time.Time) string {
+	if d.layout == "" {
+		return ""
+	}
+	return t.In(d.location()).Format(d.layout) + " "
+}
+
+// withTimeZone returns a copy of the preferences using the timezone.
+func (d *displayPrefs) withTimeZone(timeZone string) (*displayPrefs, error) {
+	if timeZone == "" {
+		return nil, errors.New("missing timezone")
+	}
+	return newDisplayPrefs(timeZone, d.TimeFormat)
+}
+
+// withTimeFormat returns a copy of the preferences using the time format.
+func (d *displayPrefs) withTimeFormat(timeFormat string) (*displayPrefs, error) {
+	if timeFormat == "" {
+		return nil, errors.New("missing time format")
+	}
+	return newDisplayPrefs(d.TimeZone, timeFormat)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDisplayPrefsTimestamp(t *testing.T) {
+	ts := time.Date(2018, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		timeZone   string
+		timeFormat string
+		want       string
+	}{
+		{"UTC", "rfc3339", "2018-01-02T15:04:05Z "},
+		{"America/New_York", "", "2018-01-02T10:04:05-05:00 "},
+		{"Asia/Tokyo", "short", "00:04 "},
+		{"UTC", "none", ""},
+		{"UTC", "Jan _2 15:04:05", "Jan  2 15:04:05 "},
+	}
+	for _, tt := range tests {
+		d, err := newDisplayPrefs(tt.timeZone, tt.timeFormat)
+		if err != nil {
+			t.Errorf("newDisplayPrefs(%q, %q) error: %s", tt.timeZone, tt.timeFormat, err)
+			continue
+		}
+		if got := d.timestamp(ts); got != tt.want {
+			t.Errorf("timestamp with %q and %q = %q, want %q", tt.timeZone, tt.timeFormat, got, tt.want)
+		}
+	}
+
+	if _, err := newDisplayPrefs("Mars/Olympus_Mons", ""); err == nil {
+		t.Error("expected an error for an unknown timezone")
+	}
+	if _, err := newDisplayPrefs("", "no layout here"); err == nil {
+		t.Error("expected an error for a time format without any layout elements")
+	}
+
+	m := &Message{Kind: KindChat, Time: ts, Room: "lobby", Sender: "alice", Body: "hi"}
+	none, _ := newDisplayPrefs("", "none")
+	if got, want := m.render(protoText, none), "lobby alice: hi\n"; got != want {
+		t.Errorf("render without timestamps = %q, want %q", got, want)
+	}
+}
+
+func TestDisplayPrefsSavedForAccounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tbit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "accounts")
+
+	s := NewServer()
+	s.accounts, err = openAccountStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.accounts.register("alice", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	conn := &Conn{id: 1, server: s, username: "alice", account: "alice"}
+	d, err := conn.displayPrefs().withTimeZone("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.setDisplayPrefs(d); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new session reads the preferences back from the account store.
+	s.accounts, err = openAccountStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = &Conn{id: 2, server: s, username: "Anonymous2", rooms: make(map[string]bool)}
+	if err := s.usernames.addUsername(conn.id, conn.username); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Login("alice", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.displayPrefs().TimeZone; got != "Europe/Paris" {
+		t.Fatalf("expected the saved timezone Europe/Paris after logging in, got %q", got)
+	}
+}
+
+func TestDisplayPrefsForPeerUsers(t *testing.T) {
+	s := NewServer()
+	// Connections mapped by PeerUsers have an account that isn't in the store.
+	conn := &Conn{id: 1, server: s, username: "robot", account: "robot"}
+	d, err := conn.displayPrefs().withTimeZone("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.setDisplayPrefs(d); err != nil {
+		t.Fatalf("expected the preferences of a peer user to be kept for the connection, got %v", err)
+	}
+	if got := conn.displayPrefs().TimeZone; got != "Europe/Paris" {
+		t.Fatalf("expected the timezone Europe/Paris, got %q", got)
+	}
+}
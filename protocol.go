@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The protocols a connection can use for its output, set with the /proto command.
+const (
+	protoText int32 = iota
+	protoJSON
+)
+
+// protocols maps the names used by /proto and the config file to the protocols.
+var protocols = map[string]int32{
+	"text": protoText,
+	"json": protoJSON,
+}
+
+// jsonMessage is how a Message is written to a connection using the JSON protocol.
+type jsonMessage struct {
+	Type string `json:"type"`
+	ID   uint64 `json:"id,omitempty"`
+	Time string `json:"time,omitempty"`
+	Room string `json:"room,omitempty"`
+	// User is the sender of a message or private message, or the user that joined, left or changed their username.
+	User string `json:"user,omitempty"`
+	To   string `json:"to,omitempty"`
+	Nick string `json:"nick,omitempty"`
+	Text string `json:"text"`
+	Echo bool   `json:"echo,omitempty"`
+	// Backlog is set on messages replayed from a room's history.
+	Backlog bool `json:"backlog,omitempty"`
+	// Info describes the room of an item listed by /rooms.
+	Info *RoomSummary `json:"info,omitempty"`
+}
+
+// render returns the output of the message for the protocol and display preferences of a connection.
+func (m *Message) render(proto int32, d *displayPrefs) string {
+	if proto == protoJSON {
+		return m.renderJSON(d)
+	}
+	return m.renderText(d)
+}
+
+// renderText returns the message as plain text lines.
+func (m *Message) renderText(d *displayPrefs) string {
+	// The timestamp is rendered with its trailing space so it can be left out entirely.
+	ts := d.timestamp(m.Time)
+	switch m.Kind {
+	case KindChat:
+		return fmt.Sprintf("%s%s %s: %s\n", ts, m.Room, m.Sender, m.Body)
+	case KindJoin, KindLeave, KindNick, KindSystem, KindTopic:
+		if m.Room == "" {
+			return fmt.Sprintf("%sserver: %s\n", ts, m.Body)
+		}
+		return fmt.Sprintf("%s%s server: %s\n", ts, m.Room, m.Body)
+	case KindPrivate:
+		if m.Echo {
+			return fmt.Sprintf("%s-> *%s*: %s\n", ts, m.To, m.Body)
+		}
+		return fmt.Sprintf("%s*%s*: %s\n", ts, m.Sender, m.Body)
+	case KindBacklog:
+		var b strings.Builder
+		fmt.Fprintf(&b, "--- backlog of %s ---\n", m.Room)
+		for _, r := range m.Replay {
+			b.WriteString(r.renderText(d))
+		}
+		b.WriteString("--- end of backlog ---\n")
+		return b.String()
+	case KindEnd:
+		// An empty line so the client has a way to know if the list has ended.
+		return "\n"
+	case KindPing:
+		return fmt.Sprintf("PING %s\n", m.Body)
+	case KindPong:
+		return strings.TrimSuffix(fmt.Sprintf("PONG %s", m.Body), " ") + "\n"
+	default:
+		return strings.TrimSuffix(m.Body, "\n") + "\n"
+	}
+}
+
+// renderJSON returns the message as a single line JSON object.
+// A backlog is rendered as one line for each message in its history.
+func (m *Message) renderJSON(d *displayPrefs) string {
+	if m.Kind == KindBacklog {
+		var b strings.Builder
+		for _, r := range m.Replay {
+			b.WriteString(r.jsonLine(d, true))
+		}
+		return b.String()
+	}
+	return m.jsonLine(d, false)
+}
+
+func (m *Message) jsonLine(d *displayPrefs, backlog bool) string {
+	jm := jsonMessage{
+		Type:    m.Kind.String(),
+		ID:      m.ID,
+		Room:    m.Room,
+		User:    m.Sender,
+		To:      m.To,
+		Nick:    m.Nick,
+		Text:    strings.TrimSuffix(m.Body, "\n"),
+		Echo:    m.Echo,
+		Backlog: backlog,
+		Info:    m.Info,
+	}
+	if !m.Time.IsZero() {
+		// JSON clients parse the time so it is always RFC 3339, only the timezone is the connection's.
+		jm.Time = m.Time.In(d.location()).Format(time.RFC3339)
+	}
+	b, err := json.Marshal(jm)
+	if err != nil {
+		// jsonMessage only has string, bool and integer fields so this should never happen.
+		return fmt.Sprintf("{\"type\":%q,\"text\":%q}\n", KindError, err.Error())
+	}
+	return string(b) + "\n"
+}
+
+// jsonCommand is a line of input from a connection using the JSON protocol.
+// Either Command is set, such as {"command":"say","args":["lobby","hello world"]},
+// or Text is set to announce to every room the connection is in.
+type jsonCommand struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Text    string   `json:"text"`
+}
+
+// hasControl returns true if s has a control character other than a tab. A line of text input can't
+// contain newlines, so JSON input mustn't be able to start what looks like another line of output.
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return r != '\t' && unicode.IsControl(r) }) >= 0
+}
+
+// parseJSONInput converts a JSON object into the line of input it stands for.
+func parseJSONInput(input string) (string, error) {
+	var cmd jsonCommand
+	err := json.Unmarshal([]byte(input), &cmd)
+	if err != nil {
+		return "", fmt.Errorf("invalid JSON input: %s", err)
+	}
+	for _, field := range append([]string{cmd.Command, cmd.Text}, cmd.Args...) {
+		if hasControl(field) {
+			return "", errors.New("JSON input can't contain newlines or other control characters")
+		}
+	}
+	if cmd.Command == "" {
+		if cmd.Text == "" || cmd.Text[0] == '/' {
+			return "", errors.New("JSON input needs a command or text that isn't a command")
+		}
+		return cmd.Text, nil
+	}
+	for i, arg := range cmd.Args {
+		// Only the last argument, which is the message for /say and /msg, can contain whitespace.
+		if i < len(cmd.Args)-1 && (arg == "" || strings.ContainsAny(arg, " \t")) {
+			return "", fmt.Errorf("invalid argument %q", arg)
+		}
+	}
+	return strings.Join(append([]string{"/" + strings.TrimPrefix(cmd.Command, "/")}, cmd.Args...), " "), nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageRender(t *testing.T) {
+	utc, err := newDisplayPrefs("UTC", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Message{
+		ID:     7,
+		Time:   time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+		Room:   "lobby",
+		Sender: "alice",
+		Kind:   KindChat,
+		Body:   "a: b",
+	}
+	if got, want := m.render(protoText, utc), "2018-01-02T03:04:05Z lobby alice: a: b\n"; got != want {
+		t.Fatalf("text render = %q, want %q", got, want)
+	}
+
+	var decoded jsonMessage
+	if err := json.Unmarshal([]byte(m.render(protoJSON, utc)), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	want := jsonMessage{Type: "message", ID: 7, Time: "2018-01-02T03:04:05Z", Room: "lobby", User: "alice", Text: "a: b"}
+	if decoded != want {
+		t.Fatalf("JSON render decoded to %+v, want %+v", decoded, want)
+	}
+
+	end := &Message{Kind: KindEnd}
+	if got := end.render(protoText, utc); got != "\n" {
+		t.Fatalf("expected the end of a list to be an empty line, got %q", got)
+	}
+	if got, want := end.render(protoJSON, utc), "{\"type\":\"end\",\"text\":\"\"}\n"; got != want {
+		t.Fatalf("JSON render of the end of a list = %q, want %q", got, want)
+	}
+
+	backlog := &Message{Kind: KindBacklog, Room: "lobby", Replay: []*Message{m, m}}
+	lines := strings.Split(strings.TrimSuffix(backlog.render(protoJSON, utc), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one JSON line per replayed message, got %q", lines)
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Backlog {
+		t.Fatal("expected replayed messages to be marked as backlog")
+	}
+}
+
+func TestParseJSONInput(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{`{"command":"say","args":["lobby","hello  world"]}`, "/say lobby hello  world", false},
+		{`{"command":"/join","args":["games"]}`, "/join games", false},
+		{`{"text":"hello"}`, "hello", false},
+		{`{"text":"/quit"}`, "", true},
+		{`{"command":"say","args":["two words","hi"]}`, "", true},
+		{`{}`, "", true},
+		{`{"command"`, "", true},
+		{`{"text":"hi\nlobby server: fake"}`, "", true},
+		{`{"text":"hi\r"}`, "", true},
+		{`{"text":"tab\tseparated"}`, "tab\tseparated", false},
+		{`{"command":"say","args":["lobby","hi\nfake"]}`, "", true},
+		{`{"command":"msg","args":["bob\n","hi"]}`, "", true},
+		{`{"command":"say\u0000","args":["lobby","hi"]}`, "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseJSONInput(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseJSONInput(%s) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseJSONInput(%s) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestRoomAnnounceRendersPerConnection(t *testing.T) {
+	room := NewRoom("lobby", roomOptions{})
+	text := &Conn{id: 1, outputChan: make(chan *Message, 1)}
+	jsonConn := &Conn{id: 2, outputChan: make(chan *Message, 1), proto: protoJSON}
+	room.Join(text)
+	room.Join(jsonConn)
+	room.Announce("hi", "alice")
+
+	// Both connections get the same message, each renders it for its own protocol.
+	var e jsonMessage
+	if err := json.Unmarshal([]byte((<-jsonConn.outputChan).render(jsonConn.protocol(), jsonConn.displayPrefs())), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "message" || e.Room != "lobby" || e.User != "alice" || e.Text != "hi" {
+		t.Fatalf("unexpected JSON message %+v", e)
+	}
+	if got, want := (<-text.outputChan).render(text.protocol(), text.displayPrefs()), e.Time+" lobby alice: hi\n"; got != want {
+		t.Fatalf("text message = %q, want %q", got, want)
+	}
+}
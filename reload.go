@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+)
+
+// reloadableSettings are the settings that a SIGHUP applies to the running server.
+// Changing any other setting needs a restart.
+var reloadableSettings = map[string]bool{
+	"LogFile":          true,
+	"HistorySize":      true,
+	"RequireLogin":     true,
+	"TLSCertFile":      true,
+	"TLSKeyFile":       true,
+	"SlowConsumer":     true,
+	"RoomSlowConsumer": true,
+	"ShutdownMessage":  true,
+	"ShutdownTimeout":  true,
+	"OutputBufferSize": true,
+	"DefaultRoom":      true,
+	"WelcomeText":      true,
+	"HelpText":         true,
+	"IdleTimeout":      true,
+	"PingTimeout":      true,
+	"WriteTimeout":     true,
+	"TCPKeepAlive":     true,
+	"MaxConns":         true,
+	"MaxConnsPerIP":    true,
+	"IPv4PrefixLen":    true,
+	"IPv6PrefixLen":    true,
+	"AcceptRate":       true,
+	"AcceptBurst":      true,
+	"Admins":           true,
+	"AdminPassword":    true,
+	"AuditLogFile":     true,
+	"Room":             true,
+	"EmptyRoomTimeout": true,
+	"WebSocketOrigins": true,
+}
+
+// secretSettings are the settings whose values aren't logged when they change.
+// Room is one since rooms can have keys.
+var secretSettings = map[string]bool{
+	"AdminPassword": true,
+	"Room":          true,
+}
+
+// process is what main keeps of the running server so it can be reconfigured and shut down by signals.
+type process struct {
+	server *Server
+	// cl is the command line, it is used to read the settings again with the same overrides.
+	cl *commandLine
+	// config holds the settings currently in effect.
+	config    settings
+	logFile   *os.File
+	auditFile *os.File
+}
+
+// handleSignals reloads the config file on SIGHUP and shuts the server down on SIGINT or SIGTERM.
+// It returns once the server has shut down and exits if a listener fails.
+func (p *process) handleSignals(errs <-chan error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case err := <-errs:
+			log.Fatal(err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				err := p.reload()
+				if err != nil {
+					log.Printf("error reloading config file, keeping the current settings: %s\n", err)
+					continue
+				}
+				log.Print("reloaded config file")
+				continue
+			}
+			log.Printf("received %s, shutting down\n", sig)
+			p.shutdown()
+			return
+		}
+	}
+}
+
+// shutdown shuts the server down, giving connections ShutdownTimeout to receive their remaining messages.
+func (p *process) shutdown() {
+	// A second signal kills the server without waiting for the shutdown to finish.
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	// The timeout was checked when the config was loaded.
+	timeout, _ := p.config.shutdownTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := p.server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("error shutting down: %s\n", err)
+		return
+	}
+	log.Print("shut down")
+}
+
+// reload reads the config file again, along with the environment and command line overrides, and applies the
+// reloadable settings to the running server. If the config file is invalid, or a new log file or TLS
+// certificate can't be opened, nothing is changed.
+func (p *process) reload() error {
+	next, err := p.cl.loadSettings()
+	if err != nil {
+		return err
+	}
+	err = next.validate()
+	if err != nil {
+		return err
+	}
+	applied, changes := reloadSettings(p.config, next)
+	opts, _ := applied.options()
+
+	logFile := p.logFile
+	if applied.LogFile != p.config.LogFile {
+		logFile, err = openLogFile(applied.LogFile)
+		if err != nil {
+			return err
+		}
+	}
+	auditFile := p.auditFile
+	if applied.AuditLogFile != p.config.AuditLogFile {
+		auditFile, err = openLogFile(applied.AuditLogFile)
+		if err != nil {
+			if logFile != p.logFile {
+				logFile.Close()
+			}
+			return err
+		}
+	}
+	if p.server.TLSAddr != "" {
+		err = p.server.certs.load(applied.TLSCertFile, applied.TLSKeyFile)
+	}
+	if err == nil {
+		// The certificate files of the listeners can't change without a restart, but their contents can.
+		err = p.server.listenerCerts.reload()
+	}
+	if err != nil {
+		if logFile != p.logFile {
+			logFile.Close()
+		}
+		if auditFile != p.auditFile {
+			auditFile.Close()
+		}
+		return fmt.Errorf("error loading TLS certificates: %s", err)
+	}
+
+	for _, change := range changes {
+		log.Printf("config: %s\n", change)
+	}
+	if logFile != p.logFile {
+		log.SetOutput(io.MultiWriter(logFile, os.Stderr))
+		p.logFile.Close()
+		p.logFile = logFile
+	}
+	if auditFile != p.auditFile {
+		p.server.SetAuditLog(auditFile)
+		p.auditFile.Close()
+		p.auditFile = auditFile
+	}
+	p.server.Reload(opts)
+	p.config = applied
+	return nil
+}
+
+// reloadSettings returns the settings in effect after reloading next on top of current, which are the
+// reloadable settings of next and the rest of current. It also describes each setting that changed.
+func reloadSettings(current, next settings) (settings, []string) {
+	applied := current
+	var changes []string
+	cv, nv, av := reflect.ValueOf(current), reflect.ValueOf(next), reflect.ValueOf(&applied).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		name := cv.Type().Field(i).Name
+		if reflect.DeepEqual(cv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if !reloadableSettings[name] {
+			changes = append(changes, fmt.Sprintf("%s changed to %v but needs a restart to take effect", name, nv.Field(i).Interface()))
+			continue
+		}
+		if secretSettings[name] {
+			changes = append(changes, fmt.Sprintf("%s changed", name))
+		} else {
+			changes = append(changes, fmt.Sprintf("%s changed from %v to %v", name, cv.Field(i).Interface(), nv.Field(i).Interface()))
+		}
+		av.Field(i).Set(nv.Field(i))
+	}
+	return applied, changes
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tbit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tbit.conf")
+
+	config := defaultSettings()
+	s := NewServer()
+	s.Options, err = config.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lobby, _ := s.rooms.create("lobby", s.roomOptions("lobby"))
+	p := &process{server: s, cl: &commandLine{config: path, lookupEnv: noEnv}, config: config}
+
+	err = ioutil.WriteFile(path, []byte(`
+Port = "1234"
+HistorySize = 5
+RequireLogin = true
+
+[RoomSlowConsumer.lobby]
+Policy = "drop-oldest"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.reload(); err != nil {
+		t.Fatal(err)
+	}
+	opts := s.options()
+	if opts.HistorySize != 5 || !opts.RequireLogin {
+		t.Errorf("expected the reloadable settings to be applied, got %+v", opts)
+	}
+	if lobby.slow.Mode != DropOldest {
+		t.Errorf("expected the lobby to use its new slow consumer policy, got %+v", lobby.slow)
+	}
+	if p.config.Port != "9999" {
+		t.Errorf("expected Port to need a restart, got %q", p.config.Port)
+	}
+
+	err = ioutil.WriteFile(path, []byte(`
+HistorySize = 50
+
+[SlowConsumer]
+Timeout = "soon"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.reload(); err == nil {
+		t.Fatal("expected an invalid config to be rejected")
+	}
+	if opts := s.options(); opts.HistorySize != 5 || opts.SlowConsumer.Timeout != time.Second {
+		t.Errorf("expected the settings to be kept after an invalid config, got %+v", opts)
+	}
+}
+
+func TestReloadSettings(t *testing.T) {
+	current := defaultSettings()
+	next := defaultSettings()
+	next.Host = "example.com"
+	next.ShutdownMessage = "bye"
+	applied, changes := reloadSettings(current, next)
+	if applied.Host != current.Host || applied.ShutdownMessage != "bye" {
+		t.Errorf("expected only the reloadable settings to change, got %+v", applied)
+	}
+	want := []string{
+		"Host changed to example.com but needs a restart to take effect",
+		"ShutdownMessage changed from " + defaultShutdownMessage + " to bye",
+	}
+	if len(changes) != len(want) || changes[0] != want[0] || changes[1] != want[1] {
+		t.Errorf("changes = %q, want %q", changes, want)
+	}
+}
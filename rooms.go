@@ -1,8 +1,9 @@
 package main
 
 import (
-	"fmt"
+	"errors"
 	"log"
+	"sort"
 	"sync"
 	"time"
 )
@@ -10,45 +11,151 @@ import (
 // Room stores a list of the connections that are currently in the room.
 type Room struct {
 	sync.RWMutex
-	Name  string
-	Conns map[int]*Conn
+	Name    string
+	Conns   map[int]*Conn
+	history *history
+	slow    SlowConsumerPolicy
+	// recipients are the connections in Conns, a new slice is made when one leaves so queued messages keep
+	// the members they were sent to. dispatcher delivers the room's messages.
+	recipients []*Conn
+	dispatcher *dispatcher
+	// ops are the ids of the connections that operate the room, see ops.go.
+	ops map[int]bool
+	// bans stop matching connections from joining and mutes stop connections from talking until they expire.
+	bans  []ban
+	mutes []ban
+	// invites are the connection ids that can join once whatever the modes are.
+	invites map[int]bool
+	// emptySince is when the last connection left the room, removed is set once it has been removed from the server.
+	emptySince time.Time
+	removed    bool
+	roomInfo
+	roomModes
 }
 
-// NewRoom creates an empty room
-func NewRoom(name string) *Room {
+// roomOptions are the settings a room is created with.
+type roomOptions struct {
+	// historySize is the number of recent messages replayed to connections joining the room.
+	historySize int
+	// slowConsumer is what to do with messages for connections that aren't keeping up.
+	slowConsumer SlowConsumerPolicy
+}
+
+// NewRoom creates an empty room.
+func NewRoom(name string, opts roomOptions) *Room {
 	return &Room{
-		Conns: make(map[int]*Conn),
-		Name:  name,
+		Conns:      make(map[int]*Conn),
+		Name:       name,
+		dispatcher: newDispatcher(),
+		history:    newHistory(opts.historySize),
+		slow:       opts.slowConsumer,
+		ops:        make(map[int]bool),
+		invites:    make(map[int]bool),
+		emptySince: time.Now(),
+		roomInfo: roomInfo{
+			created: time.Now(),
+			creator: "server",
+		},
+		roomModes: defaultRoomModes,
 	}
 }
 
-// Join joins a connection to a room.
-func (r *Room) Join(conn *Conn) {
+// Join joins a connection to a room and replays the room's recent history to it.
+// Connections that are banned from the room can't join.
+func (r *Room) Join(conn *Conn) error {
 	r.Lock()
 	defer r.Unlock()
+	if r.removed {
+		return errRoomRemoved
+	}
+	if r.bannedLocked(conn) {
+		return errors.New("You are banned from that room")
+	}
+	if _, ok := r.Conns[conn.id]; !ok {
+		r.recipients = append(r.recipients, conn)
+	}
 	r.Conns[conn.id] = conn
+
+	// The backlog is queued while holding the lock so that it arrives before any new messages for the room.
+	// It is sent as a single backlog message so it always fits in the buffer of a new connection.
+	backlog := r.history.last()
+	if len(backlog) == 0 {
+		return nil
+	}
+	conn.deliver(&Message{Kind: KindBacklog, Room: r.Name, Replay: backlog}, SlowConsumerPolicy{Mode: DropNewest})
+	return nil
 }
 
-// Leave removes a connection from a room.
+// setSlowConsumer changes the slow consumer policy used for messages to the room.
+func (r *Room) setSlowConsumer(p SlowConsumerPolicy) {
+	r.Lock()
+	defer r.Unlock()
+	r.slow = p
+}
+
+// Leave removes a connection from a room, it stops being an operator of the room.
 func (r *Room) Leave(conn *Conn) {
 	r.Lock()
 	defer r.Unlock()
+	if _, ok := r.Conns[conn.id]; ok {
+		recipients := make([]*Conn, 0, len(r.recipients)-1)
+		for _, c := range r.recipients {
+			if c.id != conn.id {
+				recipients = append(recipients, c)
+			}
+		}
+		r.recipients = recipients
+	}
 	delete(r.Conns, conn.id)
+	delete(r.ops, conn.id)
+	if len(r.Conns) == 0 {
+		r.emptySince = time.Now()
+	}
 }
 
-// Announce sends a message to all connections in a room.
-func (r *Room) Announce(msg, username string) {
-	// TODO(pmo): Allow users to set their timezone. This will require setting the timestamp in the receiving Conn.
-	roomMsg := fmt.Sprintf("%s %s %s: %s\n", time.Now().Format(time.RFC3339), r.Name, username, msg)
-	log.Printf("%s %s: %s\n", r.Name, username, msg)
+// has returns true if the connection id is in the room.
+func (r *Room) has(id int) bool {
 	r.RLock()
 	defer r.RUnlock()
-	for id, conn := range r.Conns {
-		select {
-		case conn.outputChan <- roomMsg:
-		case <-time.After(1 * time.Second):
-			// TODO(pmo): tune this timeout and/or add to config variables.
-			log.Printf("timeout sending to outputChan %d", id)
+	_, ok := r.Conns[id]
+	return ok
+}
+
+// listUsernames returns a sorted list of the usernames of the connections in the room.
+// Operators are marked with an @ in front of their username.
+func (r *Room) listUsernames(ul *usernameList) []string {
+	r.RLock()
+	defer r.RUnlock()
+	list := make([]string, 0, len(r.Conns))
+	for id := range r.Conns {
+		name := ul.getUsername(id)
+		if r.ops[id] {
+			name = "@" + name
 		}
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Announce sends a message to all connections in a room.
+func (r *Room) Announce(msg, username string) {
+	r.broadcast(&Message{Kind: KindChat, Sender: username, Body: msg})
+}
+
+// broadcast stamps a message, adds it to the room's history and sends it to all connections in the room.
+// Large rooms are delivered to by the room's dispatcher, so the sender doesn't wait on the fan-out,
+// and delivery never blocks, so a connection that isn't reading can't hold up the room.
+func (r *Room) broadcast(m *Message) {
+	m.stamp()
+	m.Room = r.Name
+	if m.Kind == KindChat {
+		log.Printf("%s %s: %s\n", r.Name, m.Sender, m.Body)
+	} else {
+		log.Printf("%s server: %s\n", r.Name, m.Body)
 	}
+	r.RLock()
+	defer r.RUnlock()
+	r.history.add(m)
+	r.dispatcher.send(dispatch{m: m, members: r.recipients, slow: r.slow})
 }
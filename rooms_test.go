@@ -1,9 +1,17 @@
 package main
 
-import "testing"
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestJoinAndLeave(t *testing.T) {
-	room := NewRoom("testRoom")
+	room := NewRoom("testRoom", roomOptions{})
 	conn := &Conn{id: 123}
 	room.Join(conn)
 	if len(room.Conns) != 1 {
@@ -17,3 +25,176 @@ func TestJoinAndLeave(t *testing.T) {
 		t.Fatalf("expected zero connections in the room, got %d", len(room.Conns))
 	}
 }
+
+func TestHistory(t *testing.T) {
+	h := newHistory(3)
+	if got := h.last(); len(got) != 0 {
+		t.Fatalf("expected empty history, got %v", got)
+	}
+	for i := 1; i <= 5; i++ {
+		h.add(&Message{Body: fmt.Sprint(i)})
+	}
+	var got []string
+	for _, m := range h.last() {
+		got = append(got, m.Body)
+	}
+	want := []string{"3", "4", "5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	h = newHistory(0)
+	h.add(&Message{Body: "1"})
+	if got := h.last(); len(got) != 0 {
+		t.Fatalf("expected disabled history to stay empty, got %v", got)
+	}
+}
+
+func TestJoinReplaysHistory(t *testing.T) {
+	room := NewRoom("testRoom", roomOptions{historySize: 2})
+	room.Announce("first", "alice")
+	room.Announce("second", "alice")
+	room.Announce("third", "alice")
+
+	conn := &Conn{id: 123, outputChan: make(chan *Message, 1)}
+	room.Join(conn)
+	msg := (<-conn.outputChan).render(protoText, defaultDisplayPrefs)
+	if strings.Contains(msg, "first") {
+		t.Fatalf("backlog should only hold the last two messages, got %q", msg)
+	}
+	if !strings.Contains(msg, "second") || !strings.Contains(msg, "third") {
+		t.Fatalf("backlog is missing messages, got %q", msg)
+	}
+	if !strings.HasPrefix(msg, "--- backlog of testRoom ---\n") {
+		t.Fatalf("backlog is not marked, got %q", msg)
+	}
+}
+
+func TestBroadcastOrderInLargeRoom(t *testing.T) {
+	room := NewRoom("testRoom", roomOptions{historySize: 2})
+	var conns []*Conn
+	for i := 0; i < inlineFanout+1; i++ {
+		c := &Conn{id: i, outputChan: make(chan *Message, 10)}
+		room.Join(c)
+		conns = append(conns, c)
+	}
+	room.Leave(conns[0])
+	for i := 0; i < 5; i++ {
+		room.Announce(strconv.Itoa(i), "alice")
+	}
+	// A connection joining while messages are queued gets the ones it missed in its backlog, not again.
+	late := &Conn{id: 1000, outputChan: make(chan *Message, 10)}
+	room.Join(late)
+	room.Announce("5", "alice")
+	room.dispatcher.wait()
+
+	if len(conns[0].outputChan) != 0 {
+		t.Errorf("expected a connection that left not to get messages, got %d", len(conns[0].outputChan))
+	}
+	for _, c := range conns[1:] {
+		for i := 0; i < 6; i++ {
+			if m := <-c.outputChan; m.Body != strconv.Itoa(i) {
+				t.Fatalf("expected message %d for connection %d, got %q", i, c.id, m.Body)
+			}
+		}
+	}
+	if m := <-late.outputChan; m.Kind != KindBacklog || len(m.Replay) != 2 || m.Replay[1].Body != "4" {
+		t.Fatalf("expected the backlog first, got %+v", m)
+	}
+	if m := <-late.outputChan; m.Body != "5" || len(late.outputChan) != 0 {
+		t.Fatalf("expected only the message sent after joining, got %q and %d more", m.Body, len(late.outputChan))
+	}
+}
+
+// discardConn is an io.ReadWriteCloser that throws away everything written to it.
+type discardConn struct{}
+
+func (discardConn) Read(p []byte) (int, error)  { return 0, nil }
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+func (discardConn) Close() error                { return nil }
+
+// benchmarkRoom creates a room with n connections that write their output with handleMessages.
+// If stalled is true one of the connections never reads its output.
+func benchmarkRoom(n int, stalled bool) (*Room, func()) {
+	room := NewRoom("bench", roomOptions{})
+	var conns []*Conn
+	for i := 0; i < n; i++ {
+		c := &Conn{
+			id:         i,
+			c:          discardConn{},
+			outputChan: make(chan *Message, defaultOutputBufferSize),
+			closeChan:  make(chan struct{}),
+		}
+		room.Join(c)
+		if stalled && i == 0 {
+			continue
+		}
+		conns = append(conns, c)
+		go c.handleMessages()
+	}
+	return room, func() {
+		for _, c := range conns {
+			c.closeChan <- struct{}{}
+		}
+	}
+}
+
+// waitDelivered waits until the room's dispatcher is idle and every connection has written its output.
+func waitDelivered(room *Room) {
+	room.dispatcher.wait()
+	for _, c := range room.members() {
+		for len(c.outputChan) > 0 {
+			runtime.Gosched()
+		}
+	}
+}
+
+// BenchmarkBroadcast sends one message at a time and waits for it to be written by every connection.
+// sender-ns/op is how long Announce kept the sender busy.
+func BenchmarkBroadcast(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		b.Run(fmt.Sprintf("members=%d", n), func(b *testing.B) {
+			room, stop := benchmarkRoom(n, false)
+			defer stop()
+			var sender time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				room.Announce("hello", "bench")
+				sender += time.Since(start)
+				waitDelivered(room)
+			}
+			b.ReportMetric(float64(sender.Nanoseconds())/float64(b.N), "sender-ns/op")
+		})
+	}
+}
+
+// BenchmarkBroadcastDelivered measures sending messages back to back until they have all been handed
+// to the connections.
+func BenchmarkBroadcastDelivered(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		b.Run(fmt.Sprintf("members=%d", n), func(b *testing.B) {
+			room, stop := benchmarkRoom(n, false)
+			defer stop()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				room.Announce("hello", "bench")
+			}
+			room.dispatcher.wait()
+		})
+	}
+}
+
+func BenchmarkBroadcastStalledMember(b *testing.B) {
+	for _, n := range []int{10, 1000} {
+		b.Run(fmt.Sprintf("members=%d", n), func(b *testing.B) {
+			room, stop := benchmarkRoom(n, true)
+			defer stop()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				room.Announce("hello", "bench")
+			}
+			room.dispatcher.wait()
+		})
+	}
+}
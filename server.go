@@ -2,20 +2,107 @@ package main
 
 import (
 	"errors"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Options are the settings of a Server that can be changed while it is running with Reload.
+type Options struct {
+	// HistorySize is the number of recent messages each room replays to connections joining it.
+	HistorySize int
+	// RequireLogin stops guests from chatting until they log in to a registered account.
+	RequireLogin bool
+	// SlowConsumer is what to do with messages for connections that aren't keeping up.
+	SlowConsumer SlowConsumerPolicy
+	// RoomSlowConsumer overrides SlowConsumer for the named rooms.
+	RoomSlowConsumer map[string]SlowConsumerPolicy
+	// ShutdownMessage is announced to every room by Shutdown.
+	ShutdownMessage string
+	// OutputBufferSize is the number of messages queued for a new connection before the slow consumer policy is used.
+	OutputBufferSize int
+	// DefaultRoom is the room connections join when they connect, or when they log in if RequireLogin is set.
+	DefaultRoom string
+	// WelcomeText is sent to new connections with {username} replaced by their username.
+	WelcomeText string
+	// HelpText is the reply to /help.
+	HelpText string
+	// IdleTimeout is how long a connection can go without sending input before it is sent a PING,
+	// then it is disconnected if it doesn't answer within PingTimeout. Connections aren't pinged if it is 0.
+	IdleTimeout time.Duration
+	PingTimeout time.Duration
+	// WriteTimeout is how long a write to a connection can take before it is disconnected, 0 means forever.
+	WriteTimeout time.Duration
+	// TCPKeepAlive is the keep alive period of TCP connections, 0 turns keep alives off.
+	TCPKeepAlive time.Duration
+	// MaxConns is the most connections the server has at once, MaxConnsPerIP is the most from one network,
+	// which is an address masked to IPv4PrefixLen or IPv6PrefixLen bits. 0 means no limit.
+	MaxConns      int
+	MaxConnsPerIP int
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+	// AcceptRate is how many new connections are accepted per second across all listeners, with bursts of up
+	// to AcceptBurst. 0 means no limit.
+	AcceptRate  int
+	AcceptBurst int
+	// Admins are the registered accounts that are admins when they log in.
+	Admins []string
+	// AdminPassword makes any connection that gives it with /admin login an admin, admins can't log in this way if it is empty.
+	AdminPassword string
+	// PermanentRooms always exist, other rooms are removed once they have been empty for EmptyRoomTimeout.
+	// Empty rooms are never removed if it is 0.
+	PermanentRooms   []PermanentRoom
+	EmptyRoomTimeout time.Duration
+	// WebSocketOrigins are the origins of other sites, such as https://chat.example.com, whose pages can open
+	// WebSocket connections. Pages served from the same host as /ws can always connect.
+	WebSocketOrigins []string
+}
+
 // Server controls the room list as well as username list.
+// Its Options can be set directly before it starts serving, after that they must be changed with Reload.
 type Server struct {
 	Addr string
+	Options
+	optionsLock sync.RWMutex
+
+	// TLSAddr, TLSCertFile and TLSKeyFile are used by ListenAndServeTLS.
+	TLSAddr     string
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSMinVersion is the minimum TLS version accepted, such as tls.VersionTLS12.
+	TLSMinVersion uint16
+	// HTTPAddr is used by ListenAndServeHTTP for browser clients.
+	HTTPAddr string
 
 	rooms     *roomList
 	usernames *usernameList
+	conns     *connList
+	accounts  *accountStore
+	certs     *certReloader
+	// listenerCerts are the certificates of the listeners started with ListenAndServeOn.
+	listenerCerts *certList
+	listeners     *listenerList
+	// peerNames are the usernames listeners map unix user ids to, guests can't take them.
+	peerNames *peerNameList
+	limits    *connLimiter
+	// audit is where admin actions are written, see SetAuditLog.
+	audit *log.Logger
+	// lastID is the last connection id handed out, it is shared by all listeners and accessed atomically.
+	lastID int64
+	// inShutdown is set to 1 by Shutdown, it is accessed atomically.
+	inShutdown int32
+	// collectRoomsOnce starts removing empty rooms when the server starts serving.
+	collectRoomsOnce sync.Once
 }
 
+// defaultRoom is the room connections join when DefaultRoom isn't set.
+const defaultRoom = "lobby"
+
 // NewServer creates a new server
 func NewServer() *Server {
 	return &Server{
@@ -26,9 +113,94 @@ func NewServer() *Server {
 			usernameToID: make(map[string]int),
 			idToUsername: make(map[int]string),
 		},
+		conns: &connList{
+			list: make(map[int]*Conn),
+		},
+		accounts: &accountStore{
+			accounts: make(map[string]*account),
+		},
+		certs:         &certReloader{},
+		listenerCerts: &certList{},
+		Options: Options{
+			ShutdownMessage:  defaultShutdownMessage,
+			OutputBufferSize: defaultOutputBufferSize,
+			DefaultRoom:      defaultRoom,
+			WelcomeText:      defaultWelcomeText,
+			HelpText:         defaultHelpText,
+			PingTimeout:      defaultPingTimeout,
+			WriteTimeout:     defaultWriteTimeout,
+			TCPKeepAlive:     defaultTCPKeepAlive,
+			IPv4PrefixLen:    defaultIPv4PrefixLen,
+			IPv6PrefixLen:    defaultIPv6PrefixLen,
+			AcceptBurst:      defaultAcceptBurst,
+			EmptyRoomTimeout: defaultEmptyRoomTimeout,
+		},
+		listeners: &listenerList{
+			list: make(map[io.Closer]bool),
+		},
+		peerNames: &peerNameList{
+			names: make(map[string]int),
+		},
+		limits: &connLimiter{
+			perIP: make(map[string]int),
+		},
+		audit: log.New(ioutil.Discard, "", log.LstdFlags),
 	}
 }
 
+// lookupConn returns the live connection using a username, or nil if nobody is using it.
+func (s *Server) lookupConn(username string) *Conn {
+	id, ok := s.usernames.getID(username)
+	if !ok {
+		return nil
+	}
+	return s.conns.get(id)
+}
+
+// broadcastAll sends a system message to every room.
+func (s *Server) broadcastAll(body string) {
+	for _, name := range s.rooms.listAll() {
+		if r := s.rooms.get(name); r != nil {
+			r.broadcast(&Message{Kind: KindSystem, Body: body})
+		}
+	}
+}
+
+// options returns the current options.
+func (s *Server) options() Options {
+	s.optionsLock.RLock()
+	defer s.optionsLock.RUnlock()
+	return s.Options
+}
+
+// Reload replaces the options of a running server. Existing rooms switch to the new slow consumer
+// policies right away, the new history size is used by rooms created after the reload.
+// New permanent rooms are created and rooms that are no longer permanent can be removed once they are empty.
+func (s *Server) Reload(opts Options) {
+	s.optionsLock.Lock()
+	s.Options = opts
+	s.optionsLock.Unlock()
+	for _, name := range s.rooms.listAll() {
+		if r := s.rooms.get(name); r != nil {
+			r.setSlowConsumer(s.roomOptions(name).slowConsumer)
+		}
+	}
+	s.ensureRooms()
+}
+
+// roomOptions returns the settings for creating the named room.
+func (s *Server) roomOptions(name string) roomOptions {
+	o := s.options()
+	opts := roomOptions{
+		historySize:  o.HistorySize,
+		slowConsumer: o.SlowConsumer,
+	}
+	if p, ok := o.RoomSlowConsumer[name]; ok {
+		opts.slowConsumer = p
+	}
+	return opts
+}
+
 // ListenAndServe listens on `Addr` and spawns connections in their own goroutine.
 func (s *Server) ListenAndServe() error {
 	ln, err := net.Listen("tcp", s.Addr)
@@ -36,39 +208,108 @@ func (s *Server) ListenAndServe() error {
 		return err
 	}
 	log.Printf("Listening on %s\n", s.Addr)
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on the listener and spawns them in their own goroutine.
+// Serve can be called with multiple listeners, they all share the same rooms and usernames.
+// After Shutdown is called Serve returns ErrServerClosed.
+func (s *Server) Serve(ln net.Listener) error {
+	return s.serve(ln, nil)
+}
+
+// serve accepts connections on the listener, applying the policy of l to them if it isn't nil.
+func (s *Server) serve(ln net.Listener, l *Listener) error {
 	defer ln.Close()
-	id := 1
-	s.rooms.create("lobby")
+	if !s.listeners.add(ln) {
+		return ErrServerClosed
+	}
+	defer s.listeners.remove(ln)
+	s.ensureRooms()
+	s.collectRoomsOnce.Do(func() { go s.collectRoomsEvery(roomGCInterval) })
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
-		// log the RemoteAddr here because NewConn() stores it as a io.ReadWriteCloser
-		log.Printf("New connection id %d from %s\n", id, conn.RemoteAddr().String())
-		c := s.NewConn(conn, id)
+		s.setKeepAlive(conn)
+		c := s.accept(conn, conn.RemoteAddr().String(), l)
 		if c == nil {
-			conn.Close()
 			continue
 		}
 		go c.handleConnection()
-		id++
 	}
 }
 
+// accept assigns a new connection its id and creates its Conn with the policy of the listener it came from,
+// which is nil for connections without a Listener. Connections over the limits are rejected before they
+// are given an id. The connection is closed if that fails.
+func (s *Server) accept(conn io.ReadWriteCloser, remoteAddr string, l *Listener) *Conn {
+	if s.shuttingDown() {
+		conn.Close()
+		return nil
+	}
+	key, reason := s.limits.admit(remoteAddr, s.options())
+	if reason != "" {
+		// Rejecting is done in its own goroutine so a client that doesn't read can't hold up the listener.
+		go s.reject(conn, remoteAddr, l, reason)
+		return nil
+	}
+	id := int(atomic.AddInt64(&s.lastID, 1))
+	// log the RemoteAddr here because NewConn() stores it as a io.ReadWriteCloser
+	log.Printf("New connection id %d from %s\n", id, remoteAddr)
+	c := s.NewConn(conn, id, l)
+	if c == nil {
+		s.limits.release(key)
+		conn.Close()
+		return nil
+	}
+	c.admitted = true
+	c.limitKey = key
+	return c
+}
+
 // roomList encapsulates the list of rooms
 type roomList struct {
 	sync.RWMutex
 	list map[string]*Room
 }
 
-// create creates a new room
-func (rl *roomList) create(name string) *Room {
+// create creates the named room with opts, created is false if it already existed and it was returned instead.
+func (rl *roomList) create(name string, opts roomOptions) (r *Room, created bool) {
 	rl.Lock()
 	defer rl.Unlock()
-	r := NewRoom(name)
-	rl.list[name] = r
-	return r
+	r, ok := rl.list[name]
+	if !ok {
+		r = NewRoom(name, opts)
+		rl.list[name] = r
+	}
+	return r, !ok
+}
+
+// remove deletes the named room.
+func (rl *roomList) remove(name string) {
+	rl.removeIf(name, func(*Room) bool { return true })
+}
+
+// removeIf deletes the named room if remove returns true, remove is called with the room locked.
+// The room is marked as removed so it can't be joined by anyone that got it before it was deleted.
+func (rl *roomList) removeIf(name string, remove func(*Room) bool) {
+	rl.Lock()
+	defer rl.Unlock()
+	r, ok := rl.list[name]
+	if !ok {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if remove(r) {
+		r.removed = true
+		delete(rl.list, name)
+	}
 }
 
 // get returns the named room
@@ -94,6 +335,56 @@ func (rl *roomList) listAll() []string {
 	return list
 }
 
+// roomsWith returns a list of the names of all the rooms the connection id is in
+func (rl *roomList) roomsWith(id int) []string {
+	list := []string{}
+	for _, name := range rl.listAll() {
+		r := rl.get(name)
+		if r != nil && r.has(id) {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// connList encapsulates the mapping of connection id to the live connection.
+type connList struct {
+	sync.RWMutex
+	list map[int]*Conn
+}
+
+// add stores a new connection
+func (cl *connList) add(c *Conn) {
+	cl.Lock()
+	defer cl.Unlock()
+	cl.list[c.id] = c
+}
+
+// remove removes a connection. Used for disconnecting connections.
+func (cl *connList) remove(id int) {
+	cl.Lock()
+	defer cl.Unlock()
+	delete(cl.list, id)
+}
+
+// get returns the connection for the id
+func (cl *connList) get(id int) *Conn {
+	cl.RLock()
+	defer cl.RUnlock()
+	return cl.list[id]
+}
+
+// all returns all the live connections.
+func (cl *connList) all() []*Conn {
+	cl.RLock()
+	defer cl.RUnlock()
+	list := make([]*Conn, 0, len(cl.list))
+	for _, c := range cl.list {
+		list = append(list, c)
+	}
+	return list
+}
+
 // usernameList encapsulates the mapping of id to username and visa versa.
 type usernameList struct {
 	sync.RWMutex
@@ -108,6 +399,14 @@ func (ul *usernameList) getUsername(id int) string {
 	return ul.idToUsername[id]
 }
 
+// getID returns the connection id using the username
+func (ul *usernameList) getID(name string) (int, bool) {
+	ul.RLock()
+	defer ul.RUnlock()
+	id, ok := ul.usernameToID[name]
+	return id, ok
+}
+
 // addUsername creates a username for a new connection id
 func (ul *usernameList) addUsername(id int, name string) error {
 	ul.Lock()
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLookupConnAndRoomsWith(t *testing.T) {
+	s := NewServer()
+	conn := &Conn{id: 7, server: s}
+	if err := s.usernames.addUsername(conn.id, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	s.conns.add(conn)
+	lobby, _ := s.rooms.create("lobby", roomOptions{})
+	lobby.Join(conn)
+	s.rooms.create("empty", roomOptions{})
+
+	if got := s.lookupConn("alice"); got != conn {
+		t.Fatalf("expected to find conn 7 for alice, got %v", got)
+	}
+	if got := s.lookupConn("bob"); got != nil {
+		t.Fatalf("expected no conn for bob, got %v", got)
+	}
+	if got, want := s.rooms.roomsWith(conn.id), []string{"lobby"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected rooms %v, got %v", want, got)
+	}
+	if got, want := s.rooms.get("lobby").listUsernames(s.usernames), []string{"alice"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected users %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and the ListenAndServe methods after Shutdown has been called.
+var ErrServerClosed = errors.New("tbit: server closed")
+
+// defaultShutdownMessage is announced to every room by Shutdown when ShutdownMessage isn't set.
+const defaultShutdownMessage = "The server is shutting down for maintenance"
+
+// shutdownPollInterval is how often Shutdown checks if the connections have written all their messages.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown stops the server gracefully. It closes the listeners, announces ShutdownMessage to every room,
+// waits for each connection to write the messages queued for it and then closes it through Conn.Close.
+// Shutdown returns once every connection is closed. If ctx expires first the remaining connections
+// are disconnected without waiting and the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+	s.listeners.closeAll()
+
+	msg := s.options().ShutdownMessage
+	if msg == "" {
+		msg = defaultShutdownMessage
+	}
+	s.broadcastAll(msg)
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		conns := s.conns.all()
+		if len(conns) == 0 {
+			return nil
+		}
+		for _, c := range conns {
+			if c.drained() {
+				c.stopReading()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			for _, c := range s.conns.all() {
+				c.disconnect("server shut down before its messages were written")
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// shuttingDown returns true once Shutdown has been called.
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+// drained returns true once the connection has no messages waiting to be written.
+func (c *Conn) drained() bool {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	return len(c.outputChan) == 0 && len(c.pending) == 0
+}
+
+// stopReading makes handleConnection stop reading input so it closes the connection through Close,
+// which waits for handleMessages to finish the message it is writing.
+// Connections that don't support read deadlines are disconnected instead.
+func (c *Conn) stopReading() {
+	if d, ok := c.c.(interface{ SetReadDeadline(time.Time) error }); ok {
+		if d.SetReadDeadline(time.Now()) == nil {
+			return
+		}
+	}
+	c.disconnect("server shutting down")
+}
+
+// listenerList tracks the listeners and HTTP servers that are accepting connections so Shutdown can close them.
+type listenerList struct {
+	sync.Mutex
+	list   map[io.Closer]bool
+	closed bool
+}
+
+// add adds a listener. It returns false if the list has already been closed.
+func (ll *listenerList) add(l io.Closer) bool {
+	ll.Lock()
+	defer ll.Unlock()
+	if ll.closed {
+		return false
+	}
+	ll.list[l] = true
+	return true
+}
+
+// remove removes a listener once it has stopped accepting connections.
+func (ll *listenerList) remove(l io.Closer) {
+	ll.Lock()
+	defer ll.Unlock()
+	delete(ll.list, l)
+}
+
+// closeAll closes all the listeners and stops any more from being added.
+func (ll *listenerList) closeAll() {
+	ll.Lock()
+	defer ll.Unlock()
+	ll.closed = true
+	for l := range ll.list {
+		l.Close()
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	s := NewServer()
+	s.ShutdownMessage = "back soon"
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	// Wait for the reply to /list so the connection is in the lobby before shutting down.
+	conn.Write([]byte("/list\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "lobby\n" {
+			break
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("expected Serve to return ErrServerClosed, got %v", err)
+	}
+
+	var announced bool
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if strings.HasSuffix(line, "lobby server: back soon\n") {
+			announced = true
+		}
+	}
+	if !announced {
+		t.Fatal("expected the shutdown message before the connection was closed")
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Fatal("expected the listener to be closed")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := NewServer()
+	closer := &closeRecorder{}
+	// Nothing writes the output of this connection so it is never drained.
+	c := &Conn{id: 1, c: closer, server: s, outputChan: make(chan *Message, 1)}
+	c.outputChan <- &Message{}
+	s.conns.add(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the context to expire, got %v", err)
+	}
+	if !closer.closed {
+		t.Fatal("expected the connection to be disconnected when the context expired")
+	}
+}
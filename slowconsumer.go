@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// SlowConsumerMode is what happens to a message for a connection whose output buffer is full.
+type SlowConsumerMode int
+
+// The slow consumer modes.
+const (
+	// BlockWithTimeout holds the message until there is room in the buffer and drops it if the timeout passes first.
+	BlockWithTimeout SlowConsumerMode = iota
+	// DropNewest drops the message that doesn't fit.
+	DropNewest
+	// DropOldest drops the oldest message in the buffer to make room for the new one.
+	DropOldest
+	// Disconnect drops the message that doesn't fit and disconnects the connection after MaxDrops messages are missed.
+	Disconnect
+)
+
+// slowConsumerModes maps the config file names of the modes to their values.
+var slowConsumerModes = map[string]SlowConsumerMode{
+	"block":       BlockWithTimeout,
+	"drop-newest": DropNewest,
+	"drop-oldest": DropOldest,
+	"disconnect":  Disconnect,
+}
+
+// defaultSlowConsumerTimeout is used by BlockWithTimeout when no timeout is set.
+const defaultSlowConsumerTimeout = 1 * time.Second
+
+// SlowConsumerPolicy decides what to do when a connection isn't reading its messages fast enough.
+// The zero value blocks for up to defaultSlowConsumerTimeout.
+type SlowConsumerPolicy struct {
+	Mode     SlowConsumerMode
+	Timeout  time.Duration
+	MaxDrops int
+}
+
+// slowConsumerSettings is how a SlowConsumerPolicy is written in the config file.
+type slowConsumerSettings struct {
+	Policy   string
+	Timeout  string
+	MaxDrops int
+}
+
+// policy validates the settings. Settings that aren't set are taken from base,
+// which lets rooms override only part of the server's policy.
+func (s slowConsumerSettings) policy(base SlowConsumerPolicy) (SlowConsumerPolicy, error) {
+	p := base
+	if s.Policy != "" {
+		mode, ok := slowConsumerModes[s.Policy]
+		if !ok {
+			return p, fmt.Errorf("unknown slow consumer policy %q, use block, drop-newest, drop-oldest or disconnect", s.Policy)
+		}
+		p.Mode = mode
+	}
+	if s.Timeout != "" {
+		timeout, err := time.ParseDuration(s.Timeout)
+		if err != nil {
+			return p, fmt.Errorf("invalid slow consumer timeout: %s", err)
+		}
+		if timeout <= 0 {
+			return p, fmt.Errorf("slow consumer timeout must be positive, got %s", s.Timeout)
+		}
+		p.Timeout = timeout
+	}
+	if s.MaxDrops != 0 {
+		p.MaxDrops = s.MaxDrops
+	}
+	if p.Mode == Disconnect && p.MaxDrops <= 0 {
+		return p, fmt.Errorf("the disconnect slow consumer policy needs MaxDrops to be positive")
+	}
+	return p, nil
+}
+
+// pendingMessage is a message waiting for room in a connection's output channel.
+type pendingMessage struct {
+	m *Message
+	// deadline is when the message is dropped if it still hasn't been written, zero means never.
+	deadline time.Time
+}
+
+// deliver queues a message for the connection following the slow consumer policy.
+// It never blocks, so a room can send to all of its connections without waiting for any of them.
+func (c *Conn) deliver(m *Message, p SlowConsumerPolicy) {
+	if c.enqueue(m, p) {
+		return
+	}
+	dropped := atomic.AddInt64(&c.dropped, 1)
+	if p.Mode == Disconnect && dropped >= int64(p.MaxDrops) {
+		c.disconnect(fmt.Sprintf("missed %d messages", dropped))
+	}
+}
+
+// enqueue puts the message on the output channel, or on the pending queue when the channel is full
+// and the policy is to wait. It returns false if the message was dropped.
+func (c *Conn) enqueue(m *Message, p SlowConsumerPolicy) bool {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	// Once messages are pending new ones wait behind them so they are written in order.
+	if len(c.pending) == 0 {
+		select {
+		case c.outputChan <- m:
+			return true
+		default:
+		}
+	}
+
+	switch p.Mode {
+	case BlockWithTimeout:
+		timeout := p.Timeout
+		if timeout == 0 {
+			timeout = defaultSlowConsumerTimeout
+		}
+		now := time.Now()
+		c.expirePending(now)
+		// The pending queue is limited to the size of the buffer so a stalled connection can't use up the memory.
+		if len(c.pending) >= cap(c.outputChan) {
+			return false
+		}
+		c.pending = append(c.pending, pendingMessage{m: m, deadline: now.Add(timeout)})
+		return true
+	case DropOldest:
+		if len(c.pending) > 0 {
+			c.pending = append(c.pending[1:], pendingMessage{m: m})
+			atomic.AddInt64(&c.dropped, 1)
+			return true
+		}
+		select {
+		case <-c.outputChan:
+		default:
+		}
+		select {
+		case c.outputChan <- m:
+			atomic.AddInt64(&c.dropped, 1)
+			return true
+		default:
+			// handleMessages didn't take anything, but another sender filled the space, so this one is dropped.
+		}
+	}
+	return false
+}
+
+// expirePending drops the messages at the front of the pending queue whose deadline has passed.
+// The caller must hold pendingLock.
+func (c *Conn) expirePending(now time.Time) {
+	i := 0
+	for i < len(c.pending) && !c.pending[i].deadline.IsZero() && now.After(c.pending[i].deadline) {
+		i++
+	}
+	if i > 0 {
+		atomic.AddInt64(&c.dropped, int64(i))
+		c.pending = c.pending[i:]
+	}
+}
+
+// takePending returns the pending messages that haven't expired and empties the queue.
+// It only takes them once the output channel is empty so nothing is written out of order.
+func (c *Conn) takePending() []*Message {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	if len(c.pending) == 0 || len(c.outputChan) != 0 {
+		return nil
+	}
+	now := time.Now()
+	msgs := make([]*Message, 0, len(c.pending))
+	for _, p := range c.pending {
+		if !p.deadline.IsZero() && now.After(p.deadline) {
+			atomic.AddInt64(&c.dropped, 1)
+			continue
+		}
+		msgs = append(msgs, p.m)
+	}
+	c.pending = nil
+	return msgs
+}
+
+// missedNotice returns a notice of how many messages were dropped since the last notice, or nil if none were.
+func (c *Conn) missedNotice() *Message {
+	dropped := atomic.SwapInt64(&c.dropped, 0)
+	if dropped == 0 {
+		return nil
+	}
+	m := &Message{Kind: KindSystem, Body: fmt.Sprintf("You missed %d messages because you were not keeping up", dropped)}
+	m.stamp()
+	return m
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// fullConn returns a connection whose output buffer of one message is already full.
+func fullConn() (*Conn, *Message) {
+	first := &Message{Kind: KindChat, Body: "first"}
+	c := &Conn{id: 1, outputChan: make(chan *Message, 1)}
+	c.outputChan <- first
+	return c, first
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	second := &Message{Kind: KindChat, Body: "second"}
+
+	c, first := fullConn()
+	start := time.Now()
+	c.deliver(second, SlowConsumerPolicy{Mode: BlockWithTimeout, Timeout: time.Hour})
+	if time.Since(start) > time.Second {
+		t.Error("expected block to hold the message without waiting")
+	}
+	if got := c.takePending(); got != nil {
+		t.Errorf("block: expected pending messages to wait for the buffer to empty, got %d", len(got))
+	}
+	if got := <-c.outputChan; got != first {
+		t.Errorf("block: expected the first message to be written first, got %q", got.Body)
+	}
+	if got := c.takePending(); len(got) != 1 || got[0] != second || c.dropped != 0 {
+		t.Errorf("block: expected the held message once the buffer is empty, got %v with %d dropped", got, c.dropped)
+	}
+
+	c, _ = fullConn()
+	c.deliver(second, SlowConsumerPolicy{Mode: BlockWithTimeout, Timeout: time.Millisecond})
+	<-c.outputChan
+	time.Sleep(5 * time.Millisecond)
+	if got := c.takePending(); len(got) != 0 || c.dropped != 1 {
+		t.Errorf("block: expected the held message to be dropped after the timeout, got %v with %d dropped", got, c.dropped)
+	}
+
+	c, first = fullConn()
+	c.deliver(second, SlowConsumerPolicy{Mode: DropNewest})
+	if got := <-c.outputChan; got != first || c.dropped != 1 {
+		t.Errorf("drop-newest: expected the new message to be dropped, got %q with %d dropped", got.Body, c.dropped)
+	}
+
+	c, _ = fullConn()
+	c.deliver(second, SlowConsumerPolicy{Mode: DropOldest})
+	if got := <-c.outputChan; got != second || c.dropped != 1 {
+		t.Errorf("drop-oldest: expected the old message to be dropped, got %q with %d dropped", got.Body, c.dropped)
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	c, _ := fullConn()
+	closer := &closeRecorder{}
+	c.c = closer
+	policy := SlowConsumerPolicy{Mode: Disconnect, MaxDrops: 2}
+	c.deliver(&Message{}, policy)
+	if closer.closed {
+		t.Fatal("expected the connection to stay open after one drop")
+	}
+	c.deliver(&Message{}, policy)
+	if !closer.closed {
+		t.Fatal("expected the connection to be closed after MaxDrops drops")
+	}
+}
+
+func TestMissedNotice(t *testing.T) {
+	c, _ := fullConn()
+	if c.missedNotice() != nil {
+		t.Fatal("expected no notice when nothing was dropped")
+	}
+	c.deliver(&Message{}, SlowConsumerPolicy{Mode: DropNewest})
+	c.deliver(&Message{}, SlowConsumerPolicy{Mode: DropNewest})
+	notice := c.missedNotice()
+	if notice == nil || !strings.Contains(notice.Body, "missed 2 messages") {
+		t.Fatalf("expected a notice about 2 missed messages, got %+v", notice)
+	}
+	if c.missedNotice() != nil {
+		t.Fatal("expected the count to be reset after the notice")
+	}
+}
+
+// closeRecorder is an io.ReadWriteCloser that records if it was closed.
+type closeRecorder struct {
+	closed bool
+}
+
+func (cr *closeRecorder) Read(p []byte) (int, error)  { return 0, nil }
+func (cr *closeRecorder) Write(p []byte) (int, error) { return len(p), nil }
+func (cr *closeRecorder) Close() error {
+	cr.closed = true
+	return nil
+}
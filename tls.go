@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// tlsVersions maps the config file names of TLS versions to their values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion converts a version such as "1.2" to its tls package value.
+func parseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", version)
+	}
+	return v, nil
+}
+
+// errTLSNotEnabled is returned when reloading certificates if no listener uses TLS.
+var errTLSNotEnabled = errors.New("TLS is not enabled")
+
+// certReloader holds the current certificate so it can be replaced without restarting the listener.
+type certReloader struct {
+	sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+// load sets the certificate and key files and reads them.
+func (cr *certReloader) load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cr.Lock()
+	defer cr.Unlock()
+	cr.certFile = certFile
+	cr.keyFile = keyFile
+	cr.cert = &cert
+	return nil
+}
+
+// reload reads the certificate and key files again. The old certificate is kept if they can't be loaded.
+func (cr *certReloader) reload() error {
+	cr.RLock()
+	certFile, keyFile := cr.certFile, cr.keyFile
+	cr.RUnlock()
+	if certFile == "" {
+		return errTLSNotEnabled
+	}
+	return cr.load(certFile, keyFile)
+}
+
+// getCertificate is used as tls.Config.GetCertificate so each handshake uses the current certificate.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.RLock()
+	defer cr.RUnlock()
+	return cr.cert, nil
+}
+
+// listenTLS creates a TLS listener on addr using the server's certificate.
+func (s *Server) listenTLS(addr string) (net.Listener, error) {
+	err := s.certs.load(s.TLSCertFile, s.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: s.certs.getCertificate,
+		MinVersion:     s.TLSMinVersion,
+	}
+	return tls.Listen("tcp", addr, config)
+}
+
+// ListenAndServeTLS listens for TLS connections on `TLSAddr` and spawns connections in their own goroutine.
+func (s *Server) ListenAndServeTLS() error {
+	ln, err := s.listenTLS(s.TLSAddr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Listening for TLS on %s\n", s.TLSAddr)
+	return s.Serve(ln)
+}
+
+// ReloadCertificates reads the TLS certificate and key files of every TLS listener again.
+// Existing connections are not affected.
+func (s *Server) ReloadCertificates() error {
+	err := s.certs.reload()
+	if err == errTLSNotEnabled {
+		if s.listenerCerts.len() == 0 {
+			return err
+		}
+		err = nil
+	}
+	e := s.listenerCerts.reload()
+	if err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a new self-signed certificate and key for 127.0.0.1 with the serial number.
+func writeSelfSignedCert(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "tbit test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dialTLS connects to the server and returns the connection after reading the first welcome line.
+func dialTLS(t *testing.T, addr string) (*tls.Conn, *bufio.Reader) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	return conn, r
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tbit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeSelfSignedCert(t, certFile, keyFile, 1)
+
+	s := NewServer()
+	s.TLSCertFile = certFile
+	s.TLSKeyFile = keyFile
+	s.TLSMinVersion = tls.VersionTLS12
+	ln, err := s.listenTLS("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	first, firstReader := dialTLS(t, ln.Addr().String())
+	defer first.Close()
+	if serial := first.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 1 {
+		t.Fatalf("expected certificate serial 1, got %d", serial)
+	}
+
+	writeSelfSignedCert(t, certFile, keyFile, 2)
+	if err := s.ReloadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+
+	second, _ := dialTLS(t, ln.Addr().String())
+	defer second.Close()
+	if serial := second.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Fatalf("expected reloaded certificate serial 2, got %d", serial)
+	}
+
+	// The connection made before the reload should still work.
+	if _, err := first.Write([]byte("/list\n")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		line, err := firstReader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "You are in the following rooms:\n" {
+			break
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// roomInfo is the metadata of a room.
+type roomInfo struct {
+	created time.Time
+	// creator is the username of whoever created the room, or "server" for rooms the server made.
+	creator     string
+	topic       string
+	topicBy     string
+	topicSet    time.Time
+	description string
+	// permanent is set for rooms that are never removed for being empty, definition is what they were
+	// last set up from, see ensureRooms.
+	permanent  bool
+	definition PermanentRoom
+}
+
+// info returns the metadata of the room.
+func (r *Room) info() roomInfo {
+	r.RLock()
+	defer r.RUnlock()
+	return r.roomInfo
+}
+
+// setCreator records who created the room.
+func (r *Room) setCreator(username string) {
+	r.Lock()
+	defer r.Unlock()
+	r.creator = username
+}
+
+// setTopic changes the topic of the room and tells everyone in it.
+func (r *Room) setTopic(topic, username string) {
+	r.Lock()
+	r.topic = topic
+	r.topicBy = username
+	r.topicSet = time.Now()
+	r.Unlock()
+	r.broadcast(&Message{Kind: KindTopic, Sender: username, Body: fmt.Sprintf("%s changed the topic to: %s", username, topic)})
+}
+
+// setDescription changes the description of the room.
+func (r *Room) setDescription(description string) {
+	r.Lock()
+	defer r.Unlock()
+	r.description = description
+}
+
+// count returns the number of connections in the room.
+func (r *Room) count() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.Conns)
+}
+
+// topicMessage returns the message telling a connection the topic of the room, or nil if it has no topic.
+func (r *Room) topicMessage() *Message {
+	info := r.info()
+	if info.topic == "" {
+		return nil
+	}
+	m := &Message{
+		Kind:   KindTopic,
+		Room:   r.Name,
+		Sender: info.topicBy,
+		Body:   fmt.Sprintf("Topic: %s (set by %s)", info.topic, info.topicBy),
+	}
+	m.stamp()
+	return m
+}
+
+// canDescribe returns an error if the connection isn't allowed to change the topic or description of the room.
+// Anyone in the room can change them unless its topic mode is set, then only operators can. Admins always can,
+// override is set when they could only change them as an admin so the change can be audited.
+func (c *Conn) canDescribe(r *Room) (override bool, err error) {
+	if !r.has(c.id) {
+		err = errors.New("You are not in that room")
+	} else if r.modes().topicLocked && !r.isOp(c.id) {
+		err = errors.New("Only operators can change the topic of that room")
+	}
+	if err != nil && c.isAdmin() {
+		return true, nil
+	}
+	return false, err
+}
+
+// Topic shows the topic of a room, or changes it if topic isn't empty.
+func (c *Conn) Topic(roomName, topic string) error {
+	r := c.visibleRoom(roomName)
+	if r == nil {
+		return errors.New("That room does not exist")
+	}
+	if topic == "" {
+		info := r.info()
+		if info.topic == "" {
+			c.replyf("%s has no topic", roomName)
+			return nil
+		}
+		c.replyf("Topic of %s: %s (set by %s at %s)", roomName, info.topic, info.topicBy, info.topicSet.Format(time.RFC3339))
+		return nil
+	}
+	override, err := c.canDescribe(r)
+	if err != nil {
+		return err
+	}
+	if override {
+		c.auditf("changed the topic of %s to %q", roomName, topic)
+	}
+	r.setTopic(topic, c.name())
+	return nil
+}
+
+// Describe changes the description of a room.
+func (c *Conn) Describe(roomName, description string) error {
+	r := c.visibleRoom(roomName)
+	if r == nil {
+		return errors.New("That room does not exist")
+	}
+	override, err := c.canDescribe(r)
+	if err != nil {
+		return err
+	}
+	if override {
+		c.auditf("changed the description of %s to %q", roomName, description)
+	}
+	r.setDescription(description)
+	c.replyf("Description of %s set", roomName)
+	return nil
+}
+
+// RoomInfo shows the metadata of a room.
+func (c *Conn) RoomInfo(roomName string) error {
+	r := c.visibleRoom(roomName)
+	if r == nil {
+		return errors.New("That room does not exist")
+	}
+	info := r.info()
+	c.replyList(fmt.Sprintf("About %s:", roomName), []string{
+		"topic: " + info.topic,
+		"description: " + info.description,
+		"created: " + info.created.Format(time.RFC3339) + " by " + info.creator,
+		"users: " + strconv.Itoa(r.count()),
+		"modes: " + r.modes().String(),
+		"permanent: " + strconv.FormatBool(info.permanent),
+	})
+	return nil
+}
+
+// summary returns what /rooms shows about the room.
+func (r *Room) summary() *RoomSummary {
+	info := r.info()
+	return &RoomSummary{Users: r.count(), Topic: info.topic, Permanent: info.permanent}
+}
+
+// replyRooms lists the rooms. Text connections get a table, JSON connections get an item for each room
+// named by its text with the rest of the table in its info.
+func (c *Conn) replyRooms(rooms []*Room) {
+	title := "Here is a list of the current rooms:"
+	if c.protocol() != protoJSON {
+		c.replyList(title, roomTable(rooms))
+		return
+	}
+	c.write(&Message{Kind: KindList, Body: title})
+	for _, r := range rooms {
+		c.write(&Message{Kind: KindItem, Body: r.Name, Info: r.summary()})
+	}
+	c.write(&Message{Kind: KindEnd})
+}
+
+// roomTable returns the rooms as the rows of a table with their member counts, whether they are permanent
+// or were made by someone joining them, and their topics, below a header row.
+func roomTable(rooms []*Room) []string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ROOM\tUSERS\tTYPE\tTOPIC")
+	for _, r := range rooms {
+		summary := r.summary()
+		kind := "ad-hoc"
+		if summary.Permanent {
+			kind = "permanent"
+		}
+		// Tabs in the topic would start new columns.
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", r.Name, summary.Users, kind, strings.Replace(summary.Topic, "\t", " ", -1))
+	}
+	w.Flush()
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	for i := range lines {
+		// Rooms without a topic leave the padding of the last column behind.
+		lines[i] = strings.TrimRight(lines[i], " ")
+	}
+	return lines
+}
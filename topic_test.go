@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTopic(t *testing.T) {
+	s := NewServer()
+	alice := testConn(t, s, 1, "alice", "192.0.2.1:1000")
+	bob := testConn(t, s, 2, "bob", "192.0.2.2:1000")
+	if err := alice.JoinRoom("den", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.JoinRoom("den", ""); err != nil {
+		t.Fatal(err)
+	}
+	den := s.rooms.get("den")
+	if info := den.info(); info.creator != "alice" || info.created.IsZero() {
+		t.Errorf("expected alice to be recorded as the creator, got %+v", info)
+	}
+
+	if err := bob.Topic("den", "bob's den now"); err == nil {
+		t.Fatal("expected only operators to change the topic by default")
+	}
+	if err := alice.Topic("den", "all about dens"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Mode("den", "-topic", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Describe("den", "a quiet place"); err != nil {
+		t.Fatalf("expected anyone to describe the room once the topic mode is off, got %s", err)
+	}
+	if info := den.info(); info.topic != "all about dens" || info.topicBy != "alice" || info.description != "a quiet place" {
+		t.Errorf("unexpected room info %+v", info)
+	}
+	if err := bob.Mode("den", "+topic", ""); err == nil {
+		t.Error("expected only operators to change the modes")
+	}
+
+	carol := testConn(t, s, 3, "carol", "192.0.2.3:1000")
+	if err := carol.JoinRoom("den", ""); err != nil {
+		t.Fatal(err)
+	}
+	var topic *Message
+	for len(carol.outputChan) > 0 {
+		if m := <-carol.outputChan; m.Kind == KindTopic {
+			topic = m
+		}
+	}
+	if topic == nil || topic.Room != "den" || topic.Body != "Topic: all about dens (set by alice)" {
+		t.Errorf("expected the topic to be sent when joining, got %+v", topic)
+	}
+}
+
+func TestRoomTable(t *testing.T) {
+	lobby := NewRoom("lobby", roomOptions{})
+	lobby.Join(&Conn{id: 1})
+	lobby.topic = "say\thi"
+	lobby.permanent = true
+	den := NewRoom("den", roomOptions{})
+	got := roomTable([]*Room{den, lobby})
+	want := []string{
+		"ROOM   USERS  TYPE       TOPIC",
+		"den    0      ad-hoc",
+		"lobby  1      permanent  say hi",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("roomTable =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// recordConn is an io.ReadWriteCloser that keeps everything written to it.
+type recordConn struct {
+	bytes.Buffer
+}
+
+func (*recordConn) Close() error { return nil }
+
+func TestReplyRoomsJSON(t *testing.T) {
+	s := NewServer()
+	alice := testConn(t, s, 1, "alice", "192.0.2.1:1000")
+	out := &recordConn{}
+	alice.c = out
+	alice.proto = protoJSON
+	if err := alice.JoinRoom("den", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Topic("den", "dens"); err != nil {
+		t.Fatal(err)
+	}
+	s.ensureRooms()
+	out.Reset()
+
+	alice.handleCommand("/rooms")
+	var items []jsonMessage
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		var m jsonMessage
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("expected JSON, got %q", line)
+		}
+		if m.Type == "item" {
+			items = append(items, m)
+		}
+	}
+	want := []jsonMessage{
+		{Type: "item", Text: "den", Info: &RoomSummary{Users: 1, Topic: "dens"}},
+		{Type: "item", Text: defaultRoom, Info: &RoomSummary{Permanent: true}},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("expected an item for each room with its details, got %+v", items)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the client's key to compute the Sec-WebSocket-Accept header, see RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxFrameSize limits the size of a message from a client, matching the default max line size of bufio.Scanner.
+const maxFrameSize = bufio.MaxScanTokenSize
+
+// closeFrameTimeout limits how long Close waits to send the close frame to a client that isn't reading.
+const closeFrameTimeout = 100 * time.Millisecond
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// wsConn wraps a WebSocket connection as the io.ReadWriteCloser used by Conn.
+// Each text message read becomes one line of input and each Write is sent as one text message.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// pending holds input that has been read from a message but not yet returned by Read.
+	pending []byte
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+// RemoteAddr returns the address of the client so NewConn can store it.
+func (ws *wsConn) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+// SetReadDeadline sets the deadline for reading input, Shutdown uses it to stop reading from the client.
+func (ws *wsConn) SetReadDeadline(t time.Time) error {
+	return ws.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writing frames to the client.
+func (ws *wsConn) SetWriteDeadline(t time.Time) error {
+	return ws.conn.SetWriteDeadline(t)
+}
+
+// Read returns the input of text messages, each followed by a newline.
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for len(ws.pending) == 0 {
+		msg, err := ws.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		ws.pending = append(msg, '\n')
+	}
+	n := copy(p, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
+}
+
+// readMessage reads frames until it has a complete text message, answering control frames along the way.
+func (ws *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	inText := false
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case opPing:
+			err = ws.writeFrame(opPong, payload)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			ws.writeFrame(opClose, payload)
+			return nil, io.EOF
+		case opText:
+			inText = true
+			msg = payload
+		case opBinary:
+			// Only text messages are input, binary messages are ignored.
+			inText = false
+			msg = nil
+		case opContinuation:
+			if len(msg)+len(payload) > maxFrameSize {
+				return nil, errors.New("websocket message too large")
+			}
+			msg = append(msg, payload...)
+		default:
+			return nil, errors.New("unknown websocket opcode")
+		}
+		if fin && inText {
+			return msg, nil
+		}
+	}
+}
+
+// readFrame reads and unmasks a single frame from the client.
+func (ws *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	_, err = io.ReadFull(ws.r, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	// The reserved bits are only used by extensions, and none are negotiated.
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("websocket frame has reserved bits set")
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("websocket frame from client is not masked")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(ws.r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(ws.r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if length > maxFrameSize {
+		return false, 0, nil, errors.New("websocket frame too large")
+	}
+	var mask [4]byte
+	_, err = io.ReadFull(ws.r, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(ws.r, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame sends a single unmasked frame. The whole frame is written at once so frames from
+// handleMessages and command replies never interleave.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// Write sends p as one text message.
+func (ws *wsConn) Write(p []byte) (int, error) {
+	err := ws.writeFrame(opText, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame and closes the underlying connection.
+// It never waits for a write that is in progress, since that is how a stalled client is disconnected,
+// and the close frame is only sent if nothing else is being written.
+func (ws *wsConn) Close() error {
+	var err error
+	ws.closeOnce.Do(func() {
+		if ws.writeLock.TryLock() {
+			// The close frame is best effort since the client may already be gone or not reading.
+			ws.conn.SetWriteDeadline(time.Now().Add(closeFrameTimeout))
+			ws.conn.Write([]byte{0x80 | opClose, 0})
+			ws.writeLock.Unlock()
+		}
+		err = ws.conn.Close()
+	})
+	return err
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept header for a Sec-WebSocket-Key.
+func websocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains returns true if the comma separated header has the token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowedOrigin returns true if the page that opened the WebSocket is on the same host as the server
+// or in origins. Requests without an Origin header don't come from browsers, so they can't be made
+// by another site on behalf of a user.
+func allowedOrigin(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range origins {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket performs the WebSocket handshake and takes over the HTTP connection.
+// Upgrades from pages on other sites are refused unless their origin is in origins.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, origins []string) (*wsConn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a websocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("not a websocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	if !allowedOrigin(r, origins) {
+		http.Error(w, "websocket origin not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("origin %s is not allowed", r.Header.Get("Origin"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return nil, errors.New("http.ResponseWriter can't be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+websocketAccept(key)+"\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: brw.Reader}, nil
+}
+
+// handleWebSocket upgrades a request and handles it as a chat connection until it disconnects.
+// The connection starts with the protocol named by the proto query parameter, text by default.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	var l *Listener
+	if name := r.URL.Query().Get("proto"); name != "" {
+		proto, ok := protocols[name]
+		if !ok {
+			http.Error(w, "unknown protocol, use text or json", http.StatusBadRequest)
+			return
+		}
+		l = &Listener{JSON: proto == protoJSON}
+	}
+	ws, err := upgradeWebSocket(w, r, s.options().WebSocketOrigins)
+	if err != nil {
+		log.Printf("error upgrading websocket from %s: %s\n", r.RemoteAddr, err)
+		return
+	}
+	s.setKeepAlive(ws.conn)
+	c := s.accept(ws, r.RemoteAddr, l)
+	if c == nil {
+		return
+	}
+	c.handleConnection()
+}
+
+// httpHandler returns the handler for the HTTP listener.
+func (s *Server) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleWebUI)
+	mux.HandleFunc("/ws", s.handleWebSocket)
+	return mux
+}
+
+// ListenAndServeHTTP listens on `HTTPAddr` for browser clients. It serves the web chat client on /
+// and upgrades /ws requests to WebSocket connections. After Shutdown is called it returns ErrServerClosed.
+func (s *Server) ListenAndServeHTTP() error {
+	srv := &http.Server{Addr: s.HTTPAddr, Handler: s.httpHandler()}
+	if !s.listeners.add(srv) {
+		return ErrServerClosed
+	}
+	defer s.listeners.remove(srv)
+	log.Printf("Listening for HTTP on %s\n", s.HTTPAddr)
+	err := srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return ErrServerClosed
+	}
+	return err
+}
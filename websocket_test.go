@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebsocketAccept(t *testing.T) {
+	// Example from RFC 6455 section 1.3.
+	if got, want := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Fatalf("websocketAccept() = %q, want %q", got, want)
+	}
+}
+
+// writeClientFrame writes a masked frame the way a browser would.
+func writeClientFrame(t *testing.T, w io.Writer, opcode byte, payload string) {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	if _, err := w.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readServerFrame reads an unmasked frame from the server.
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, string) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		t.Fatal("unexpectedly large frame")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, string(payload)
+}
+
+// dialWebSocket sends a WebSocket upgrade request for path to the test server, with an Origin header if origin isn't empty.
+func dialWebSocket(t *testing.T, ts *httptest.Server, path, origin string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, resp
+}
+
+func TestWebSocketConnection(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s.httpHandler())
+	defer ts.Close()
+
+	conn, r, resp := dialWebSocket(t, ts, "/ws", "")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected Sec-WebSocket-Accept %q", got)
+	}
+
+	writeClientFrame(t, conn, opPing, "hi")
+	writeClientFrame(t, conn, opText, "/list")
+	gotPong := false
+	for {
+		opcode, payload := readServerFrame(t, r)
+		if opcode == opPong && payload == "hi" {
+			gotPong = true
+		}
+		if opcode == opText && payload == "You are in the following rooms:\n" {
+			break
+		}
+	}
+	if !gotPong {
+		t.Fatal("expected a pong before the reply to /list")
+	}
+	if opcode, payload := readServerFrame(t, r); opcode != opText || payload != "lobby\n" {
+		t.Fatalf("expected the lobby in its own text frame, got opcode %d %q", opcode, payload)
+	}
+
+	writeClientFrame(t, conn, opClose, "")
+	for {
+		opcode, _ := readServerFrame(t, r)
+		if opcode == opClose {
+			break
+		}
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	s := NewServer()
+	s.WebSocketOrigins = []string{"https://chat.example.com"}
+	ts := httptest.NewServer(s.httpHandler())
+	defer ts.Close()
+
+	for origin, want := range map[string]int{
+		ts.URL:                     http.StatusSwitchingProtocols,
+		"https://chat.example.com": http.StatusSwitchingProtocols,
+		"https://evil.example.com": http.StatusForbidden,
+		"null":                     http.StatusForbidden,
+	} {
+		conn, _, resp := dialWebSocket(t, ts, "/ws", origin)
+		conn.Close()
+		if resp.StatusCode != want {
+			t.Errorf("expected status %d for origin %s, got %d", want, origin, resp.StatusCode)
+		}
+	}
+}
+
+func TestWebSocketReservedBits(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s.httpHandler())
+	defer ts.Close()
+
+	conn, r, _ := dialWebSocket(t, ts, "/ws", "")
+	defer conn.Close()
+	// A text frame with RSV1 set, as if it were compressed.
+	conn.Write([]byte{0x80 | 0x40 | opText, 0x80, 1, 2, 3, 4})
+	// The server has to close the connection rather than ignore the frame.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if opcode, _ := readServerFrame(t, r); opcode == opClose {
+			return
+		}
+	}
+}
+
+func TestWebSocketCloseDoesNotWaitForWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ws := &wsConn{conn: server, r: bufio.NewReader(server)}
+	// Nothing reads from client, so the write stalls holding the write lock.
+	go ws.Write([]byte("stalled"))
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		ws.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected Close not to wait for a stalled write")
+	}
+}
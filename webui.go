@@ -0,0 +1,249 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// handleWebUI serves the bundled chat client. It has no external assets so it works on offline networks.
+func handleWebUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, webUIPage)
+}
+
+// webUIPage is a single page client that uses the JSON protocol over /ws, so it can tell which room
+// each message is for whatever timestamp format the user has chosen with /set timefmt.
+// Lists are read from their list message up to the end message.
+var webUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Tbit chat</title>
+<style>
+body { margin: 0; font-family: sans-serif; display: flex; flex-direction: column; height: 100vh; }
+#tabs { display: flex; flex-wrap: wrap; background: #ddd; }
+#tabs button { border: none; padding: 6px 12px; background: #ddd; cursor: pointer; }
+#tabs button.active { background: #fff; font-weight: bold; }
+#tabs button.unread { color: #c00; }
+#main { flex: 1; display: flex; min-height: 0; }
+#log { flex: 1; overflow-y: auto; padding: 6px; font-family: monospace; white-space: pre-wrap; }
+#users { width: 160px; overflow-y: auto; border-left: 1px solid #ccc; padding: 6px; }
+#users h4 { margin: 0 0 6px 0; }
+#bar { display: flex; border-top: 1px solid #ccc; }
+#input { flex: 1; padding: 6px; font-size: 1em; }
+.time { color: #888; }
+.server { color: #666; font-style: italic; }
+.private { color: #07a; }
+</style>
+</head>
+<body>
+<div id="tabs"></div>
+<div id="main">
+<div id="log"></div>
+<div id="users"><h4>Users</h4><div id="userlist"></div></div>
+</div>
+<div id="bar">
+<input id="input" autocomplete="off" placeholder="Type a message or a /command">
+<button id="join">Join</button>
+<button id="leave">Leave</button>
+<button id="nick">Username</button>
+</div>
+<script>
+(function() {
+	var SERVER_TAB = "*server*";
+	var tabs = {};
+	var order = [SERVER_TAB];
+	var active = SERVER_TAB;
+	var users = {};
+	// list is set while reading a list reply, it collects items until the end message.
+	var list = null;
+	var ws;
+
+	tabs[SERVER_TAB] = {lines: [], unread: false};
+
+	function el(tag, cls, text) {
+		var e = document.createElement(tag);
+		if (cls) { e.className = cls; }
+		if (text !== undefined) { e.textContent = text; }
+		return e;
+	}
+
+	function addTab(name) {
+		if (!tabs[name]) {
+			tabs[name] = {lines: [], unread: false};
+			order.push(name);
+		}
+	}
+
+	function removeTab(name) {
+		if (name === SERVER_TAB || !tabs[name]) { return; }
+		delete tabs[name];
+		order.splice(order.indexOf(name), 1);
+		if (active === name) { active = SERVER_TAB; }
+	}
+
+	function addLine(tab, line) {
+		addTab(tab);
+		tabs[tab].lines.push(line);
+		if (tab !== active) { tabs[tab].unread = true; }
+		render();
+	}
+
+	function render() {
+		var bar = document.getElementById("tabs");
+		bar.innerHTML = "";
+		order.forEach(function(name) {
+			var b = el("button", "", name);
+			if (name === active) { b.className = "active"; }
+			else if (tabs[name].unread) { b.className = "unread"; }
+			b.onclick = function() { selectTab(name); };
+			bar.appendChild(b);
+		});
+		var log = document.getElementById("log");
+		log.innerHTML = "";
+		tabs[active].lines.forEach(function(line) { log.appendChild(line); });
+		log.scrollTop = log.scrollHeight;
+		var ul = document.getElementById("userlist");
+		ul.innerHTML = "";
+		(users[active] || []).forEach(function(u) { ul.appendChild(el("div", "", u)); });
+	}
+
+	function selectTab(name) {
+		active = name;
+		tabs[name].unread = false;
+		if (name !== SERVER_TAB) { send("/who " + name); }
+		render();
+	}
+
+	function send(text) {
+		if (ws && ws.readyState === WebSocket.OPEN) { ws.send(text); }
+	}
+
+	function chatLine(time, user, msg, cls) {
+		var d = el("div", cls);
+		d.appendChild(el("span", "time", (time || "").replace(/^.*T/, "").replace(/[-+Z].*$/, "") + " "));
+		d.appendChild(document.createTextNode(user + ": " + msg));
+		return d;
+	}
+
+	function handleLine(line) {
+		if (line === "") { return; }
+		var m;
+		try {
+			m = JSON.parse(line);
+		} catch (e) {
+			addLine(active, el("div", "server", line));
+			return;
+		}
+		switch (m.type) {
+		case "ping":
+			send("/pong " + m.text);
+			return;
+		case "list":
+			var who = m.text.match(/^Users in (\S+):$/);
+			if (m.text === "You are in the following rooms:") {
+				list = {kind: "rooms", items: []};
+			} else if (who) {
+				list = {kind: "who", room: who[1], items: []};
+			} else {
+				list = {kind: "other", title: m.text, items: []};
+			}
+			return;
+		case "item":
+			if (list) { list.items.push(m.text); }
+			return;
+		case "end":
+			if (list) { finishList(); }
+			return;
+		case "private":
+			addLine(active, chatLine(m.time, (m.echo ? "-> *" + m.to : "*" + m.user) + "*", m.text, "private"));
+			return;
+		case "message":
+			addLine(m.room, chatLine(m.time, m.user, m.text, ""));
+			return;
+		case "join":
+		case "leave":
+		case "nick":
+		case "system":
+		case "topic":
+			if (m.room) {
+				addLine(m.room, chatLine(m.time, "server", m.text, "server"));
+				if (!m.backlog && (m.type === "join" || m.type === "leave" || m.type === "nick")) {
+					send("/who " + m.room);
+				}
+				return;
+			}
+		}
+		addLine(active === SERVER_TAB ? SERVER_TAB : active, el("div", "server", m.text));
+	}
+
+	function finishList() {
+		if (list.kind === "rooms") {
+			var joined = {};
+			list.items.forEach(function(r) { joined[r] = true; addTab(r); });
+			order.slice().forEach(function(r) { if (r !== SERVER_TAB && !joined[r]) { removeTab(r); } });
+			if (active === SERVER_TAB && list.items.length > 0) { selectTab(list.items[0]); }
+		} else if (list.kind === "who") {
+			users[list.room] = list.items;
+		} else {
+			var tab = active === SERVER_TAB ? SERVER_TAB : active;
+			[list.title].concat(list.items).forEach(function(t) { addLine(tab, el("div", "server", t)); });
+		}
+		list = null;
+		render();
+	}
+
+	function handleFrame(data) {
+		var lines = data.split("\n");
+		if (lines.length > 1 && lines[lines.length - 1] === "") { lines.pop(); }
+		lines.forEach(handleLine);
+	}
+
+	function connect() {
+		var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+		ws = new WebSocket(scheme + location.host + "/ws?proto=json");
+		ws.onopen = function() { send("/list"); };
+		ws.onmessage = function(e) { handleFrame(e.data); };
+		ws.onclose = function() {
+			addLine(SERVER_TAB, el("div", "server", "Disconnected from the server. Reload the page to reconnect."));
+		};
+	}
+
+	var input = document.getElementById("input");
+	input.onkeydown = function(e) {
+		if (e.key !== "Enter" || input.value === "") { return; }
+		var text = input.value;
+		input.value = "";
+		if (text.charAt(0) === "/") {
+			send(text);
+			if (/^\/(join|leave)\s/.test(text)) { send("/list"); }
+		} else if (active === SERVER_TAB) {
+			addLine(SERVER_TAB, el("div", "server", "Select a room tab to chat, or use /say <room> <message>"));
+		} else {
+			send("/say " + active + " " + text);
+		}
+	};
+	document.getElementById("join").onclick = function() {
+		var room = prompt("Room to join:");
+		if (room) { send("/join " + room.trim()); send("/list"); }
+	};
+	document.getElementById("leave").onclick = function() {
+		if (active !== SERVER_TAB) { send("/leave " + active); send("/list"); }
+	};
+	document.getElementById("nick").onclick = function() {
+		var name = prompt("New username:");
+		if (name) { send("/user " + name.trim()); }
+	};
+
+	render();
+	connect();
+	input.focus();
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebUI(t *testing.T) {
+	ts := httptest.NewServer(NewServer().httpHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), `"/ws?proto=json"`) {
+		t.Fatal("expected the page to connect to /ws with the JSON protocol")
+	}
+	// The page must work on an offline network so it can't load anything from elsewhere.
+	for _, external := range []string{`src="http`, `href="http`, `src="//`, `href="//`} {
+		if strings.Contains(string(body), external) {
+			t.Fatalf("page references an external asset: %s", external)
+		}
+	}
+
+	resp, err = http.Get(ts.URL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status 404 for an unknown path, got %d", resp.StatusCode)
+	}
+}
+
+// TestWebUIProtocol checks the messages the page reads are the same whatever timestamp format the user chose.
+func TestWebUIProtocol(t *testing.T) {
+	ts := httptest.NewServer(NewServer().httpHandler())
+	defer ts.Close()
+
+	conn, r, resp := dialWebSocket(t, ts, "/ws?proto=json", "")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101, got %d", resp.StatusCode)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, format := range []string{"short", "none", "Jan _2 15:04:05"} {
+		writeClientFrame(t, conn, opText, "/set timefmt "+format)
+		writeClientFrame(t, conn, opText, "/say lobby hi")
+		var m jsonMessage
+		for m.Type != "message" {
+			_, payload := readServerFrame(t, r)
+			if err := json.Unmarshal([]byte(payload), &m); err != nil {
+				t.Fatalf("expected JSON, got %q", payload)
+			}
+		}
+		if _, err := time.Parse(time.RFC3339, m.Time); err != nil || m.Room != "lobby" || m.Text != "hi" {
+			t.Errorf("with timefmt %s expected a message the page can place in the lobby, got %+v", format, m)
+		}
+	}
+
+	conn, _, resp = dialWebSocket(t, ts, "/ws?proto=xml", "")
+	conn.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown protocol, got %d", resp.StatusCode)
+	}
+}